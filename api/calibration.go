@@ -0,0 +1,226 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/BlueMasters/thymio-captain/robotclient"
+	"github.com/BlueMasters/thymio-captain/sim"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+const (
+	// calibrationPoll is the interval between two checks of a robot being
+	// calibrated.
+	calibrationPoll = time.Second
+	// calibrationTimeout bounds the duration of a calibration.
+	calibrationTimeout = 2 * time.Minute
+)
+
+// RobotState is the state of a robot with the date of its last calibration.
+type RobotState struct {
+	robotclient.State
+	Calibrated *time.Time `json:"calibrated,omitempty"`
+}
+
+// GetRobotState is the handler for the "GET /robot/{robotName}/state" method
+func GetRobotState(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	robot, err := store.Robot(vars["robotName"])
+	if report(w, err) != nil {
+		return
+	}
+	state, err := robotClient(robot).State()
+	if reportRobot(w, robot, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(RobotState{state, robot.Calibrated})
+}
+
+// CalibrateRobot is the handler for the "POST /robot/{robotName}/calibrate/{calibration}"
+// method. The calibration ("line", "rotation" or "wall") runs on the robot and
+// the new constants are recorded when it is over.
+func CalibrateRobot(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	robot, err := store.Robot(vars["robotName"])
+	if report(w, err) != nil {
+		return
+	}
+	log.Infof("Starting %v calibration of robot: %v", vars["calibration"], robot.Name)
+	err = robotClient(robot).Calibrate(vars["calibration"])
+	if reportRobot(w, robot, err) != nil {
+		return
+	}
+	go awaitCalibration(robot)
+	robotOK(w)
+}
+
+// awaitCalibration waits until the robot has finished its calibration and
+// records the new constants.
+func awaitCalibration(robot Robot) {
+	c := robotClient(robot)
+	deadline := time.Now().Add(calibrationTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(calibrationPoll)
+		state, err := c.State()
+		if err != nil {
+			log.Infof("Calibration of robot %v: %v", robot.Name, err)
+			continue
+		}
+		if state.Running {
+			continue
+		}
+		// the profile keeps the floor threshold if the firmware has none
+		profile := state.Calibration
+		if profile.Floor <= 0 {
+			profile.Floor = sim.DefaultCalibration.Floor
+			if robot.Profile != nil {
+				profile.Floor = robot.Profile.Floor
+			}
+		}
+		err = store.SetRobotCalibration(robot.Name, state.Calibration, time.Now())
+		if err == nil {
+			err = store.SetRobotProfile(robot.Name, profile)
+		}
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		log.Infof("Robot %v calibrated: %+v", robot.Name, state.Calibration)
+		return
+	}
+	log.Warnf("Calibration of robot %v not finished after %v", robot.Name, calibrationTimeout)
+}
+
+// GetRobotProfile is the handler for the "GET /robot/{robotName}/profile" method
+func GetRobotProfile(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	robot, err := store.Robot(vars["robotName"])
+	if report(w, err) != nil {
+		return
+	}
+	if robot.Profile == nil {
+		report(w, errors.New("No calibration profile"))
+		return
+	}
+	json.NewEncoder(w).Encode(robot.Profile)
+}
+
+// PutRobotProfile is the handler for the "PUT|POST /robot/{robotName}/profile" method.
+// The profile is only stored, use "POST /robot/{robotName}/profile/push" to
+// send it to the robot.
+func PutRobotProfile(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	profile := sim.DefaultCalibration
+	err = json.NewDecoder(r.Body).Decode(&profile)
+	if report(w, err) != nil {
+		return
+	}
+	if profile.CmTime <= 0 || profile.AngleTime <= 0 || profile.Wall <= 0 || profile.Floor <= 0 {
+		report(w, errors.New("Invalid calibration profile"))
+		return
+	}
+
+	err = store.SetRobotProfile(vars["robotName"], profile)
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(JsonOK{"done"})
+}
+
+// PushRobotProfile is the handler for the "POST /robot/{robotName}/profile/push" method
+func PushRobotProfile(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	robot, err := store.Robot(vars["robotName"])
+	if report(w, err) != nil {
+		return
+	}
+	if robot.Profile == nil {
+		report(w, errors.New("No calibration profile"))
+		return
+	}
+	err = pushProfile(robot)
+	if reportRobot(w, robot, err) != nil {
+		return
+	}
+	robotOK(w)
+}
+
+// pushProfile sends the calibration profile to the robot and records it as the
+// calibration of the robot.
+func pushProfile(robot Robot) error {
+	log.Infof("Pushing calibration profile to robot %v: %+v", robot.Name, *robot.Profile)
+	err := robotClient(robot).SetCalibration(*robot.Profile)
+	if err != nil {
+		return err
+	}
+	return store.SetRobotCalibration(robot.Name, *robot.Profile, time.Time{})
+}
+
+// syncCalibration is called when a robot is associated with a card. It pushes
+// the calibration profile of the robot if there is one, and otherwise reads the
+// calibration of the robot (with the "/state" method of the firmware) and
+// records it.
+func syncCalibration(name string) {
+	robot, err := store.Robot(name)
+	if err != nil {
+		log.Info(err)
+		return
+	}
+	if robot.Profile != nil {
+		err = pushProfile(robot)
+		if err != nil {
+			log.Infof("Calibration profile not pushed to robot %v: %v", name, err)
+		}
+		return
+	}
+	state, err := robotClient(robot).State()
+	if err != nil {
+		log.Infof("Calibration of robot %v not available: %v", name, err)
+		return
+	}
+	calibration := state.Calibration
+	if calibration.CmTime <= 0 || calibration.AngleTime <= 0 {
+		log.Infof("Invalid calibration for robot %v", name)
+		return
+	}
+	err = store.SetRobotCalibration(name, calibration, time.Time{})
+	if err != nil {
+		log.Info(err)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/BlueMasters/thymio-captain/sim"
+)
+
+// CardEstimate is a card with the expected duration of its program.
+type CardEstimate struct {
+	Card
+	Estimate sim.Estimate `json:"estimate"`
+}
+
+// cardCalibration returns the calibration used to predict the program of a
+// card: the calibration of the associated robot when it is known, else its
+// calibration profile, else the default calibration.
+func cardCalibration(cardId string) sim.Calibration {
+	robot, err := store.RobotForCard(cardId)
+	if err != nil {
+		return sim.DefaultCalibration
+	}
+	if robot.Calibration != nil {
+		return *robot.Calibration
+	}
+	if robot.Profile != nil {
+		return *robot.Profile
+	}
+	return sim.DefaultCalibration
+}
+
+// estimate returns the expected duration of the program of a card (see
+// cardCalibration).
+func estimate(card Card) sim.Estimate {
+	return sim.EstimateDuration(cardCalibration(card.CardId), card.Program)
+}
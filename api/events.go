@@ -0,0 +1,277 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BlueMasters/thymio-captain/sim"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Types of the events of a run.
+const (
+	EventStarted  = "started"
+	EventStep     = "step"
+	EventFinished = "finished"
+	EventStopped  = "stopped"
+	EventError    = "error"
+	EventAssigned = "assigned" // the card got a robot from the queue
+	EventReleased = "released" // the association of the card is over
+)
+
+const (
+	// watchInterval is the interval between two polls of a running robot.
+	watchInterval = 500 * time.Millisecond
+	// watchTimeout bounds the duration of a run.
+	watchTimeout = 10 * time.Minute
+	// watchErrors is the number of failed polls after which the robot is lost.
+	watchErrors = 3
+	// keepAlive is the interval between two comments sent on an idle stream.
+	keepAlive = 15 * time.Second
+)
+
+// Event is an event of the run of a card, sent to the tablets.
+type Event struct {
+	Type    string    `json:"type"`
+	CardId  string    `json:"cardId"`
+	Robot   string    `json:"robot"`
+	Step    *int      `json:"step,omitempty"`
+	Elapsed *float64  `json:"elapsed,omitempty"`
+	Outcome string    `json:"outcome,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Date    time.Time `json:"date"`
+}
+
+// hub dispatches the events to the subscribers of the cards, and keeps track of
+// the runs being watched and of the last event of each card (for the tablets
+// that cannot stream).
+var hub = struct {
+	sync.Mutex
+	subscribers map[string]map[chan Event]bool
+	runs        map[string]*watchedRun
+	last        map[string]Event
+}{
+	subscribers: make(map[string]map[chan Event]bool),
+	runs:        make(map[string]*watchedRun),
+	last:        make(map[string]Event),
+}
+
+// watchedRun is a run being watched. stoppedBy is set when the run is stopped
+// through the API.
+type watchedRun struct {
+	stoppedBy string
+}
+
+// subscribe returns a channel receiving the events of a card.
+func subscribe(cardId string) chan Event {
+	hub.Lock()
+	defer hub.Unlock()
+	ch := make(chan Event, 16)
+	if hub.subscribers[cardId] == nil {
+		hub.subscribers[cardId] = make(map[chan Event]bool)
+	}
+	hub.subscribers[cardId][ch] = true
+	return ch
+}
+
+func unsubscribe(cardId string, ch chan Event) {
+	hub.Lock()
+	defer hub.Unlock()
+	delete(hub.subscribers[cardId], ch)
+	if len(hub.subscribers[cardId]) == 0 {
+		delete(hub.subscribers, cardId)
+	}
+}
+
+// publish sends an event to the subscribers of its card. Slow subscribers lose
+// the event.
+func publish(e Event) {
+	e.Date = time.Now()
+	log.Debugf("Event: %+v", e)
+	hub.Lock()
+	defer hub.Unlock()
+	hub.last[e.CardId] = e
+	for ch := range hub.subscribers[e.CardId] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// watchRun polls the robot running the program of a card, publishes the events
+// of the run and records it until it is over. A new run of the card replaces the
+// previous one in the hub, so that a stop command reaches the last run.
+func watchRun(robot Robot, record Run) {
+	cardId := record.CardId
+	run := &watchedRun{}
+	hub.Lock()
+	hub.runs[cardId] = run
+	hub.Unlock()
+	defer func() {
+		hub.Lock()
+		if hub.runs[cardId] == run {
+			delete(hub.runs, cardId)
+		}
+		hub.Unlock()
+	}()
+
+	c := robotClient(robot)
+	c.Retries = 0
+	saveRun(record)
+	publish(Event{Type: EventStarted, CardId: cardId, Robot: robot.Name})
+	step := -1
+	errs := 0
+	for deadline := time.Now().Add(watchTimeout); time.Now().Before(deadline); {
+		time.Sleep(watchInterval)
+		state, err := c.State()
+		if err != nil {
+			if errs++; errs >= watchErrors {
+				endRun(record, OutcomeLost)
+				publish(Event{Type: EventError, CardId: cardId, Robot: robot.Name, Error: err.Error()})
+				return
+			}
+			continue
+		}
+		errs = 0
+		if state.Steps != nil {
+			record.Steps = state.Steps
+		}
+		if state.Step != nil && *state.Step != step {
+			step = *state.Step
+			s := step
+			publish(Event{Type: EventStep, CardId: cardId, Robot: robot.Name, Step: &s, Elapsed: state.Elapsed})
+		}
+		if !state.Running {
+			hub.Lock()
+			record.StoppedBy = run.stoppedBy
+			hub.Unlock()
+			outcome := state.Outcome
+			if outcome == "" || outcome == sim.Running {
+				// old firmware
+				outcome = sim.Finished
+				if record.StoppedBy != "" {
+					outcome = sim.Stopped
+				}
+			}
+			endRun(record, outcome)
+			if outcome == sim.Stopped {
+				publish(Event{Type: EventStopped, CardId: cardId, Robot: robot.Name, Outcome: outcome})
+			} else {
+				publish(Event{Type: EventFinished, CardId: cardId, Robot: robot.Name, Outcome: outcome})
+			}
+			return
+		}
+	}
+	endRun(record, OutcomeLost)
+	publish(Event{Type: EventError, CardId: cardId, Robot: robot.Name, Error: "run not finished"})
+}
+
+// endRun records the end of a run.
+func endRun(record Run, outcome string) {
+	now := time.Now()
+	record.End = &now
+	record.Outcome = outcome
+	saveRun(record)
+}
+
+func saveRun(record Run) {
+	err := store.PutRun(record)
+	if err != nil {
+		log.Errorf("Run of card %v not recorded: %v", record.CardId, err)
+	}
+}
+
+// stopWatchedRun tells the watcher of a card that its run was stopped, and by
+// whom.
+func stopWatchedRun(cardId string, by string) {
+	hub.Lock()
+	defer hub.Unlock()
+	if run := hub.runs[cardId]; run != nil {
+		run.stoppedBy = by
+	}
+}
+
+// watchingRun returns true if a run of the card is being watched.
+func watchingRun(cardId string) bool {
+	hub.Lock()
+	defer hub.Unlock()
+	return hub.runs[cardId] != nil
+}
+
+// GetCardEvents is the handler for the "GET /card/{cardId}/events" method. It
+// streams the events of the runs of the card (Server-Sent Events).
+func GetCardEvents(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		report(w, errors.New("Streaming not supported"))
+		return
+	}
+
+	cardId := vars["cardId"]
+	ch := subscribe(cardId)
+	defer unsubscribe(cardId, ch)
+	log.Infof("Streaming events of card: %v", cardId)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-ch:
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// GetCardLastEvent is the handler for the "GET /card/{cardId}/event" method. It
+// returns the last event of the card, for the tablets polling instead of
+// streaming.
+func GetCardLastEvent(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	hub.Lock()
+	e, ok := hub.last[vars["cardId"]]
+	hub.Unlock()
+	if !ok {
+		report(w, ErrNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(e)
+}
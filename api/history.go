@@ -0,0 +1,130 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BlueMasters/thymio-captain/program"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Revision is a saved version of the program of a card. Revisions are numbered
+// from 1 and never modified.
+type Revision struct {
+	CardId       string          `json:"cardId" bson:"cardId"`
+	Rev          int             `json:"rev" bson:"rev"`
+	Date         time.Time       `json:"date" bson:"date"`
+	Notes        string          `json:"notes" bson:"notes"`
+	Program      program.Program `json:"program" bson:"program"`
+	RestoredFrom int             `json:"restoredFrom,omitempty" bson:"restoredFrom,omitempty"`
+}
+
+// saveCard appends a new revision to the history of the card and stores the
+// card. The history is written first, so that a saved card always has its
+// revision.
+func saveCard(card Card, restoredFrom int) error {
+	rev, err := store.AddRevision(Revision{
+		CardId:       card.CardId,
+		Date:         time.Now(),
+		Notes:        card.Notes,
+		Program:      card.Program,
+		RestoredFrom: restoredFrom,
+	})
+	if err != nil {
+		return err
+	}
+	err = store.PutCard(card)
+	if err != nil {
+		return fmt.Errorf("Revision %d saved, but not the card: %v", rev, err)
+	}
+	return nil
+}
+
+// revisionNumber parses the {rev} variable of the route.
+func revisionNumber(vars map[string]string) (int, error) {
+	rev, err := strconv.Atoi(vars["rev"])
+	if err != nil || rev < 1 {
+		return 0, errors.New("Invalid revision")
+	}
+	return rev, nil
+}
+
+// GetHistory is the handler for the "GET /card/{cardId}/history" method
+func GetHistory(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	revisions, err := store.Revisions(vars["cardId"])
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// GetRevision is the handler for the "GET /card/{cardId}/history/{rev}" method
+func GetRevision(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	rev, err := revisionNumber(vars)
+	if report(w, err) != nil {
+		return
+	}
+
+	revision, err := store.Revision(vars["cardId"], rev)
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(revision)
+}
+
+// RestoreRevision is the handler for the "POST /card/{cardId}/restore/{rev}" method
+func RestoreRevision(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	rev, err := revisionNumber(vars)
+	if report(w, err) != nil {
+		return
+	}
+
+	revision, err := store.Revision(vars["cardId"], rev)
+	if report(w, err) != nil {
+		return
+	}
+
+	log.Infof("Restoring revision %d of card: %v", rev, vars["cardId"])
+	var card Card
+	card.CardId = vars["cardId"]
+	card.Program = revision.Program
+	card.Notes = revision.Notes
+
+	err = saveCard(card, rev)
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(JsonOK{"done"})
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BlueMasters/thymio-captain/sim"
+	log "github.com/Sirupsen/logrus"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	// leaseTime is the default duration of an association (0 for no limit).
+	leaseTime time.Duration
+	// leaseRuns is the default number of runs of an association (0 for no
+	// limit).
+	leaseRuns int
+)
+
+// reapInterval is the interval between two checks of the associations.
+const reapInterval = 5 * time.Second
+
+// Errors returned by checkLease.
+var (
+	errLeaseExpired = errors.New("Association expired")
+	errNoRunsLeft   = errors.New("No runs left")
+)
+
+// Lease holds the limits of the association of a robot with a card. Expires is
+// nil and MaxRuns is 0 when there is no limit.
+type Lease struct {
+	Start   time.Time  `json:"start" bson:"start"`
+	Expires *time.Time `json:"expires,omitempty" bson:"expires,omitempty"`
+	MaxRuns int        `json:"maxRuns,omitempty" bson:"maxRuns,omitempty"`
+}
+
+// newLease returns a lease starting now. The default limits can be overridden
+// with the "duration" (for example "10m", "0" for no limit) and "runs"
+// parameters.
+func newLease(query url.Values) (*Lease, error) {
+	d, runs := leaseTime, leaseRuns
+	var err error
+	if s := query.Get("duration"); s != "" {
+		d, err = time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("Invalid duration: %v", s)
+		}
+	}
+	if s := query.Get("runs"); s != "" {
+		runs, err = strconv.Atoi(s)
+		if err != nil || runs < 0 {
+			return nil, fmt.Errorf("Invalid number of runs: %v", s)
+		}
+	}
+	lease := &Lease{Start: time.Now(), MaxRuns: runs}
+	if d > 0 {
+		expires := lease.Start.Add(d)
+		lease.Expires = &expires
+	}
+	return lease, nil
+}
+
+// leaseRunsDone returns the number of runs made by the robot for its card
+// since the start of its lease. The run commands refused by the robot are not
+// counted.
+func leaseRunsDone(robot Robot) (int, error) {
+	runs, err := store.Runs(robot.CardId, robot.Lease.Start)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, run := range runs {
+		if run.Robot == robot.Name && run.Outcome != sim.Failed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// checkLease returns an error if the association of the robot is over: it
+// expired or all the runs are done.
+func checkLease(robot Robot) error {
+	if robot.Lease == nil {
+		return nil
+	}
+	if robot.Lease.Expires != nil && time.Now().After(*robot.Lease.Expires) {
+		return errLeaseExpired
+	}
+	if robot.Lease.MaxRuns > 0 {
+		n, err := leaseRunsDone(robot)
+		if err != nil {
+			return err
+		}
+		if n >= robot.Lease.MaxRuns {
+			return errNoRunsLeft
+		}
+	}
+	return nil
+}
+
+// reapAssociations releases the robots whose association is over. It never
+// returns.
+func reapAssociations(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		robots, err := store.Robots()
+		if err != nil {
+			log.Errorf("Reaper: %v", err)
+			continue
+		}
+		released := false
+		for _, robot := range robots {
+			if robot.CardId == "" || robot.Lease == nil {
+				continue
+			}
+			err = checkLease(robot)
+			if err == nil {
+				continue
+			}
+			// wait for the end of the last run
+			if err == errNoRunsLeft && watchingRun(robot.CardId) {
+				continue
+			}
+			log.Infof("Reaper: releasing robot %v from card %v: %v", robot.Name, robot.CardId, err)
+			releaseRobot(robot, err.Error())
+			released = true
+		}
+		if released {
+			dispatchQueue()
+		}
+	}
+}
+
+// releaseRobot stops the program of a robot and dissociates it from its card.
+func releaseRobot(robot Robot, reason string) {
+	stopWatchedRun(robot.CardId, "reaper")
+	err := robotClient(robot).Stop()
+	if err != nil {
+		log.Warnf("Reaper: robot %v not stopped: %v", robot.Name, err)
+	}
+	err = store.SetRobotCard(robot.Name, "", nil)
+	if err != nil {
+		log.Errorf("Reaper: %v", err)
+		return
+	}
+	publish(Event{Type: EventReleased, CardId: robot.CardId, Robot: robot.Name, Error: reason})
+}
@@ -24,48 +24,47 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/BlueMasters/thymio-captain/program"
+	"github.com/BlueMasters/thymio-captain/sim"
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
-	"github.com/kidstuff/mongostore"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
-	"io"
 	"net/http"
 	"net/url"
-	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
-	dbName     = "thymio_captain"
-	sessionC   = "sessions"
 	sessionKey = "session-key"
 	prefix     = "/v1"
-	cardC      = "cards"
-	robotC     = "robots"
 )
 
 type Info struct {
 	CardId  string `json:"cardId" bson:"cardId"`
-	IsAdmin bool   `json:"isAdmin" bson:"isAdmin"`
+	IsAdmin bool   `json:"isAdmin" bson:"isAdmin"` // any staff member
+	Role    string `json:"role" bson:"role"`
 }
 
 type Robot struct {
-	Name   string `json:"name" bson:"name"`
-	URL    string `json:"url" bson:"url"`
-	CardId string `json:"cardId" bson:"cardId"`
+	Name        string           `json:"name" bson:"name"`
+	URL         string           `json:"url" bson:"url"`
+	CardId      string           `json:"cardId" bson:"cardId"`
+	Calibration *sim.Calibration `json:"calibration,omitempty" bson:"calibration,omitempty"`
+	Calibrated  *time.Time       `json:"calibrated,omitempty" bson:"calibrated,omitempty"`
+	Profile     *sim.Calibration `json:"profile,omitempty" bson:"profile,omitempty"`
+	Lease       *Lease           `json:"lease,omitempty" bson:"lease,omitempty"`
+	Rev         int              `json:"rev,omitempty" bson:"rev,omitempty"` // revision uploaded to the robot
 }
 
 type Card struct {
-	CardId  string `json:"cardId" bson:"cardId"`
-	Notes   string `json:"notes" bson:"notes"`
-	Program []byte `json:"program" bson:"program"`
+	CardId  string          `json:"cardId" bson:"cardId"`
+	Notes   string          `json:"notes" bson:"notes"`
+	Program program.Program `json:"program" bson:"program"`
 }
 
 type JsonError struct {
@@ -77,41 +76,31 @@ type JsonOK struct {
 }
 
 var (
-	database *mgo.Database
-	store    *mongostore.MongoStore
+	store  Store
+	codecs []securecookie.Codec
 )
 
-// sessionValues extracts session info from the HTTP header. It first looks for a "Authorization" header and then
-// it looks for a cookie. It returns a map of the session data.
+// sessionValues extracts session info from the HTTP header. It first looks for a "Authorization" header (API token
+// or session cookie) and then it looks for a cookie. It returns a map of the session data, without the cards that
+// were revoked.
 func sessionValues(r *http.Request) (values map[interface{}]interface{}, err error) {
 	err = nil
 	// check authorization header
 	auth := r.Header.Get("Authorization")
-	if strings.HasPrefix(auth, "Cookie") {
-		log.Debugf("Authorization header: %v", auth)
-		t := strings.Split(auth, " ")
-		if len(t) <= 1 {
-			err = errors.New("Invalid Authorization header")
-		}
+	if strings.HasPrefix(auth, "Bearer ") {
+		values, err = bearerValues(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	} else if strings.HasPrefix(auth, "Cookie") {
 		var sessionID string
+		sessionID, err = cookieSessionID(auth)
+		var data string
 		if err == nil {
-			err = securecookie.DecodeMulti(sessionKey, t[len(t)-1], &sessionID, store.Codecs...)
-			log.Debugf("Session ID = %v", sessionID)
-		}
-		if err == nil {
-			if !bson.IsObjectIdHex(sessionID) {
-				err = errors.New("Invalid session ID")
-			}
+			data, err = store.SessionData(sessionID)
 		}
-		var s mongostore.Session
 		if err == nil {
-			err = database.C(sessionC).FindId(bson.ObjectIdHex(sessionID)).One(&s)
-		}
-		if err == nil {
-			err = securecookie.DecodeMulti(sessionKey, s.Data, &values, store.Codecs...)
+			err = securecookie.DecodeMulti(sessionKey, data, &values, codecs...)
 		}
 	} else {
-		session, err := store.Get(r, sessionKey)
+		session, err := store.Sessions().Get(r, sessionKey)
 		if err == nil {
 			log.Debugf("Cookie found / ID = %v", session.ID)
 			values = session.Values
@@ -120,31 +109,40 @@ func sessionValues(r *http.Request) (values map[interface{}]interface{}, err err
 	if err != nil {
 		log.Error(err.Error())
 	}
+	if values != nil {
+		checkRevoked(values)
+	}
+	return
+}
+
+// cookieSessionID returns the session ID of a "Authorization: Cookie <cookie>" header.
+func cookieSessionID(auth string) (sessionID string, err error) {
+	log.Debugf("Authorization header: %v", auth)
+	t := strings.Split(auth, " ")
+	if len(t) <= 1 {
+		return "", errors.New("Invalid Authorization header")
+	}
+	err = securecookie.DecodeMulti(sessionKey, t[len(t)-1], &sessionID, codecs...)
+	log.Debugf("Session ID = %v", sessionID)
 	return
 }
 
 // initSession "bootstrap" the HTTP session. It configure the variables in the multiplexer and returns
-// the session values. It also add cache control headers.
+// the session values (already decoded by the wrapper of the route, if any). It also add cache control headers.
 func initSession(w http.ResponseWriter, r *http.Request) (
 	vars map[string]string, values map[interface{}]interface{}, err error) {
 
 	log.Debugf("request: %v", r.URL.String())
-	database.Session.Refresh()
+	store.Refresh()
 	vars = mux.Vars(r)
 
-	values, err = sessionValues(r)
-
-	admin, ok := values["admin"]
-	if ok {
-		if admin == "1" {
-			log.Debug("admin: yes")
-		} else {
-			log.Debugf("admin: no (%v)", admin)
-		}
-	} else {
-		log.Debug("admin: UNKNOWN")
+	values, ok := r.Context().Value(sessionContextKey).(map[interface{}]interface{})
+	if !ok {
+		values, err = sessionValues(r)
 	}
 
+	log.Debugf("role: %v", sessionRole(values))
+
 	cardId, ok := values["cardId"]
 	if ok {
 		log.Debugf("cardId: %v", cardId)
@@ -157,19 +155,6 @@ func initSession(w http.ResponseWriter, r *http.Request) (
 	return
 }
 
-// checkAdmin returns nil if the session is an authorized admin.
-func checkAdmin(w http.ResponseWriter, session map[interface{}]interface{}) error {
-	value, ok := session["admin"]
-	if ok && value == "1" {
-		return nil
-	} else {
-		err := errors.New("Not authorized")
-		errorDesc, _ := json.Marshal(JsonError{err.Error()})
-		http.Error(w, string(errorDesc), 401)
-		return err
-	}
-}
-
 // report check the err argument and if not nil, it logs the error and returns the error using HTTP
 func report(w http.ResponseWriter, err error) error {
 	if err != nil {
@@ -192,9 +177,8 @@ func GetInfo(w http.ResponseWriter, r *http.Request) {
 		info.CardId = cardId.(string)
 	}
 
-	if admin, ok := session["admin"]; ok {
-		info.IsAdmin = admin == "1"
-	}
+	info.Role = sessionRole(session)
+	info.IsAdmin = hasRole(session, RoleHelper)
 
 	json.NewEncoder(w).Encode(info)
 }
@@ -206,16 +190,15 @@ func GetCard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var card Card
-	err = database.C(cardC).Find(bson.M{"cardId": vars["cardId"]}).One(&card)
-	if err == mgo.ErrNotFound {
+	card, err := store.Card(vars["cardId"])
+	if err == ErrNotFound {
 		card.CardId = vars["cardId"]
-		card.Program = []byte{}
+		card.Program = program.Program{}
 
 	} else if report(w, err) != nil {
 		return
 	}
-	json.NewEncoder(w).Encode(card)
+	json.NewEncoder(w).Encode(CardEstimate{card, estimate(card)})
 }
 
 // PutCard is the handler for the "PUT|POST /card/{cardId}" method
@@ -226,8 +209,8 @@ func PutCard(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var payload struct {
-		Program []byte `json:"program"`
-		Notes   string `json:"notes"`
+		Program json.RawMessage `json:"program"`
+		Notes   string          `json:"notes"`
 	}
 
 	err = json.NewDecoder(r.Body).Decode(&payload)
@@ -235,12 +218,17 @@ func PutCard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	prog, err := parseProgram(w, payload.Program)
+	if err != nil {
+		return
+	}
+
 	var card Card
 	card.CardId = vars["cardId"]
-	card.Program = payload.Program
+	card.Program = prog
 	card.Notes = payload.Notes
 
-	_, err = database.C(cardC).Upsert(bson.M{"cardId": vars["cardId"]}, card)
+	err = saveCard(card, 0)
 	report(w, err)
 	if err != nil {
 		return
@@ -250,54 +238,44 @@ func PutCard(w http.ResponseWriter, r *http.Request) {
 
 // GetRobots is the handler for the "GET /robots" method
 func GetRobots(w http.ResponseWriter, r *http.Request) {
-	_, session, err := initSession(w, r)
+	_, _, err := initSession(w, r)
 	if report(w, err) != nil {
 		return
 	}
 
-	if checkAdmin(w, session) != nil {
-		return
-	}
-
-	var robots []Robot
-	err = database.C(robotC).Find(nil).All(&robots)
+	robots, err := store.Robots()
 	if report(w, err) != nil {
 		return
 	}
-	json.NewEncoder(w).Encode(robots)
+	status := make([]RobotStatus, len(robots))
+	for i, robot := range robots {
+		status[i] = robotStatus(robot)
+	}
+	json.NewEncoder(w).Encode(status)
 }
 
 // GetRobot is the handler for the "GET /robot/{robotName}" method
 func GetRobot(w http.ResponseWriter, r *http.Request) {
-	vars, session, err := initSession(w, r)
+	vars, _, err := initSession(w, r)
 	if report(w, err) != nil {
 		return
 	}
 
-	if checkAdmin(w, session) != nil {
-		return
-	}
-
-	var robot Robot
-	err = database.C(robotC).Find(bson.M{"name": vars["robotName"]}).One(&robot)
+	robot, err := store.Robot(vars["robotName"])
 	if report(w, err) != nil {
 		return
 	}
-	json.NewEncoder(w).Encode(robot)
+	json.NewEncoder(w).Encode(robotStatus(robot))
 
 }
 
 // PutRobot is the handler for the "PUT|POST /robot/{robotName}" method
 func PutRobot(w http.ResponseWriter, r *http.Request) {
-	vars, session, err := initSession(w, r)
+	vars, _, err := initSession(w, r)
 	if report(w, err) != nil {
 		return
 	}
 
-	if checkAdmin(w, session) != nil {
-		return
-	}
-
 	var payload struct {
 		URL string `json:"url"`
 	}
@@ -307,35 +285,23 @@ func PutRobot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var robot Robot
-	robot.Name = vars["robotName"]
-	robot.URL = payload.URL
-	robot.CardId = ""
-
-	_, err = database.C(robotC).Upsert(
-		bson.M{"name": vars["robotName"]},
-		bson.M{
-			"$set":         bson.M{"url": robot.URL},
-			"$setOnInsert": bson.M{"cardId": ""}})
+	err = store.PutRobot(vars["robotName"], payload.URL)
 	if report(w, err) != nil {
 		return
 	}
+	dispatchQueue()
 	json.NewEncoder(w).Encode(JsonOK{"done"})
 
 }
 
 // DelRobot is the handler for the "DELETE /robot/{robotName}" method
 func DelRobot(w http.ResponseWriter, r *http.Request) {
-	vars, session, err := initSession(w, r)
+	vars, _, err := initSession(w, r)
 	if report(w, err) != nil {
 		return
 	}
 
-	if checkAdmin(w, session) != nil {
-		return
-	}
-
-	_, err = database.C(robotC).RemoveAll(bson.M{"name": vars["robotName"]})
+	err = store.DelRobot(vars["robotName"])
 	if report(w, err) != nil {
 		return
 	}
@@ -344,91 +310,78 @@ func DelRobot(w http.ResponseWriter, r *http.Request) {
 
 // PingRobot is the handler for the "GET /robot/{robotName}/ping" method
 func PingRobot(w http.ResponseWriter, r *http.Request) {
-	vars, session, err := initSession(w, r)
+	vars, _, err := initSession(w, r)
 	if report(w, err) != nil {
 		return
 	}
 
-	if checkAdmin(w, session) != nil {
-		return
-	}
-
-	var robot Robot
-	err = database.C(robotC).Find(bson.M{"name": vars["robotName"]}).One(&robot)
+	robot, err := store.Robot(vars["robotName"])
 	if report(w, err) != nil {
 		return
 	}
-	u, _ := url.Parse(robot.URL)
-	u.Path = filepath.Join(u.Path, "/ping")
-	log.Infof("Sending ping command to robot: %v", u)
-	var client http.Client
-	res, err := client.Get(u.String())
-	if report(w, err) != nil {
+	log.Infof("Sending ping command to robot: %v", robot.Name)
+	err = robotClient(robot).Ping()
+	if reportRobot(w, robot, err) != nil {
 		return
 	}
-	w.WriteHeader(res.StatusCode)
-	io.Copy(w, res.Body)
+	robotOK(w)
 }
 
 // AssociateRobot is the handler for the "PUT|POST /robot/{robotName}/card/{cardId}" method
 func AssociateRobot(w http.ResponseWriter, r *http.Request) {
-	vars, session, err := initSession(w, r)
+	vars, _, err := initSession(w, r)
 	if report(w, err) != nil {
 		return
 	}
 
-	if checkAdmin(w, session) != nil {
+	_, err = store.Card(vars["cardId"])
+	if err == ErrNotFound {
+		report(w, errors.New("Card not found"))
+		return
+	} else if report(w, err) != nil {
 		return
 	}
 
-	n, err := database.C(cardC).Find(bson.M{"cardId": vars["cardId"]}).Count()
-	if report(w, err) != nil {
+	// check if there is already an association
+	_, err = store.RobotForCard(vars["cardId"])
+	if err == nil {
+		report(w, errors.New("Robot already associated"))
 		return
-	} else if n != 1 {
-		report(w, errors.New("Card not found"))
+	} else if err != ErrNotFound {
+		report(w, err)
 		return
 	}
 
-	// check if there is already an association
-	n, err = database.C(robotC).Find(bson.M{"cardId": vars["cardId"]}).Count()
-	report(w, err)
-	if err != nil {
-		return
-	} else if n > 0 {
-		report(w, errors.New("Robot already associated"))
+	lease, err := newLease(r.URL.Query())
+	if report(w, err) != nil {
 		return
 	}
 
 	// associate the robot with the card
-	err = database.C(robotC).Update(
-		bson.M{"name": vars["robotName"]},
-		bson.M{"$set": bson.M{"cardId": vars["cardId"]}})
+	err = store.SetRobotCard(vars["robotName"], vars["cardId"], lease)
 
 	report(w, err)
 	if err != nil {
 		return
 	}
+	leaveQueue(vars["cardId"])
+	go syncCalibration(vars["robotName"])
 	json.NewEncoder(w).Encode(JsonOK{"done"})
 }
 
 // DissociateRobot is the handler for the "DELETE /robot/{robotName}/card/" method
 func DissociateRobot(w http.ResponseWriter, r *http.Request) {
-	vars, session, err := initSession(w, r)
+	vars, _, err := initSession(w, r)
 	if report(w, err) != nil {
 		return
 	}
 
-	if checkAdmin(w, session) != nil {
-		return
-	}
-
-	err = database.C(robotC).Update(
-		bson.M{"name": vars["robotName"]},
-		bson.M{"$set": bson.M{"cardId": ""}})
+	err = store.SetRobotCard(vars["robotName"], "", nil)
 
 	if report(w, err) != nil {
 		return
 	}
+	dispatchQueue()
 	json.NewEncoder(w).Encode(JsonOK{"done"})
 
 }
@@ -440,22 +393,17 @@ func PingCardRobot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var robot Robot
-	err = database.C(robotC).Find(bson.M{"cardId": vars["cardId"]}).One(&robot)
+	robot, err := store.RobotForCard(vars["cardId"])
 	if report(w, err) != nil {
 		return
 	}
 	log.Infof("Received ping command from card: %v", vars["cardId"])
-	u, _ := url.Parse(robot.URL)
-	u.Path = filepath.Join(u.Path, "/ping")
-	log.Infof("Sending ping command to robot: %v", u)
-	var client http.Client
-	res, err := client.Get(u.String())
-	if report(w, err) != nil {
+	log.Infof("Sending ping command to robot: %v", robot.Name)
+	err = robotClient(robot).Ping()
+	if reportRobot(w, robot, err) != nil {
 		return
 	}
-	w.WriteHeader(res.StatusCode)
-	io.Copy(w, res.Body)
+	robotOK(w)
 }
 
 // RunCardRobot is the handler for the "GET /card/{cardId}/run" method
@@ -465,47 +413,45 @@ func RunCardRobot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var robot Robot
-	err = database.C(robotC).Find(bson.M{"cardId": vars["cardId"]}).One(&robot)
+	robot, err := store.RobotForCard(vars["cardId"])
 	if report(w, err) != nil {
 		return
 	}
 	log.Infof("Received run command from card: %v", vars["cardId"])
-	u, _ := url.Parse(robot.URL)
-	u.Path = filepath.Join(u.Path, "/run")
-	log.Infof("Sending run command to robot: %v", u)
-	var client http.Client
-	res, err := client.Get(u.String())
-	if report(w, err) != nil {
+	if report(w, checkLease(robot)) != nil {
+		return
+	}
+	log.Infof("Sending run command to robot: %v", robot.Name)
+	record := newRun(vars["cardId"], robot)
+	err = robotClient(robot).Run()
+	if reportRobot(w, robot, err) != nil {
+		endRun(record, sim.Failed)
+		publish(Event{Type: EventError, CardId: vars["cardId"], Robot: robot.Name, Error: err.Error()})
 		return
 	}
-	w.WriteHeader(res.StatusCode)
-	io.Copy(w, res.Body)
+	go watchRun(robot, record)
+	robotOK(w)
 }
 
 // StopCardRobot is the handler for the "GET /card/{cardId}/stop" method
 func StopCardRobot(w http.ResponseWriter, r *http.Request) {
-	vars, _, err := initSession(w, r)
+	vars, session, err := initSession(w, r)
 	if report(w, err) != nil {
 		return
 	}
 
-	var robot Robot
-	err = database.C(robotC).Find(bson.M{"cardId": vars["cardId"]}).One(&robot)
+	robot, err := store.RobotForCard(vars["cardId"])
 	if report(w, err) != nil {
 		return
 	}
 	log.Infof("Received stop command from card: %v", vars["cardId"])
-	u, _ := url.Parse(robot.URL)
-	u.Path = filepath.Join(u.Path, "/stop")
-	log.Debugf("Sending stop command to robot: %v", u)
-	var client http.Client
-	res, err := client.Get(u.String())
-	if report(w, err) != nil {
+	log.Debugf("Sending stop command to robot: %v", robot.Name)
+	stopWatchedRun(vars["cardId"], stopper(session))
+	err = robotClient(robot).Stop()
+	if reportRobot(w, robot, err) != nil {
 		return
 	}
-	w.WriteHeader(res.StatusCode)
-	io.Copy(w, res.Body)
+	robotOK(w)
 }
 
 // UploadCardRobot is the handler for the "GET|PUT|POST /card/{cardId}/upload" method
@@ -515,53 +461,62 @@ func UploadCardRobot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var robot Robot
-	err = database.C(robotC).Find(bson.M{"cardId": vars["cardId"]}).One(&robot)
+	robot, err := store.RobotForCard(vars["cardId"])
 	if report(w, err) != nil {
 		return
 	}
 
-	var card Card
-	err = database.C(cardC).Find(bson.M{"cardId": vars["cardId"]}).One(&card)
+	card, err := store.Card(vars["cardId"])
 	if report(w, err) != nil {
 		return
 	}
 
-	log.Infof("Received upload command from card: %v", vars["cardId"])
-	u, _ := url.Parse(robot.URL)
-	u.Path = filepath.Join(u.Path, "/upload")
-	var client http.Client
-
-	cardJ, err := json.Marshal(card)
+	// upload the last revision, so that the runs know the program of the robot
+	// (the cards saved before the history have no revision)
+	prog, rev := card.Program, 0
+	revisions, err := store.Revisions(vars["cardId"])
 	if report(w, err) != nil {
 		return
 	}
-	log.Debugf("Uploading card to %v: %v", u, string(cardJ))
-	cReq, err := http.NewRequest("PUT", u.String(), bytes.NewReader(cardJ))
-	if report(w, err) != nil {
+	if len(revisions) > 0 {
+		prog, rev = revisions[len(revisions)-1].Program, revisions[len(revisions)-1].Rev
+	}
+
+	if checkProgram(w, prog) != nil {
 		return
 	}
-	cReq.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	res, err := client.Do(cReq)
+
+	log.Infof("Received upload command from card: %v", vars["cardId"])
+	log.Debugf("Uploading revision %d of the card to robot %v: %v", rev, robot.Name, prog)
+	err = robotClient(robot).Upload(prog)
+	if reportRobot(w, robot, err) != nil {
+		return
+	}
+	err = store.SetRobotRev(robot.Name, rev)
 	if report(w, err) != nil {
 		return
 	}
-
-	w.WriteHeader(res.StatusCode)
-	io.Copy(w, res.Body)
+	robotOK(w)
 }
 
 type CorsServer struct {
-	r *mux.Router
+	r      *mux.Router
+	domain string // domain of the session cookie
 }
 
-// ServeHTTP is a HTTP handler that implements permissive CORS rules
+// ServeHTTP is a HTTP handler that implements permissive CORS rules. The pages
+// of the domain of the cookie may also send it (the event streams of the
+// tablets cannot send an Authorization header).
 func (s *CorsServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if origin := req.Header.Get("Origin"); origin != "" {
 		rw.Header().Set("Access-Control-Allow-Origin", origin)
 		rw.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 		rw.Header().Set("Access-Control-Allow-Headers",
 			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		rw.Header().Add("Vary", "Origin")
+		if inDomain(origin, s.domain) {
+			rw.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
 	}
 	// Stop here if its Preflighted OPTIONS request
 	if req.Method == "OPTIONS" {
@@ -573,12 +528,32 @@ func (s *CorsServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	s.r.ServeHTTP(rw, req)
 }
 
+// inDomain returns true if the host of the origin is the domain or one of its
+// subdomains.
+func inDomain(origin string, domain string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || domain == "" {
+		return false
+	}
+	host := u.Hostname()
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
 func main() {
 	var port = flag.Int("port", 8081, "port")
 	var debug = flag.Bool("debug", false, "run in debug mode")
 	var domain = flag.String("domain", "thymio.tk", "Domain name (for the cookie)")
 	var mongoServer = flag.String("mongo-server", "localhost", "MongoDB server URL")
+	var storeSpec = flag.String("store", "mongo", "Storage backend (mongo[:server], bolt:file or memory)")
 	var secretKey = flag.String("secret-key", "not-so-secret", "Secret key (for secure cookies)")
+	var actionsFile = flag.String("actions", "", "Action catalog (JSON file)")
+	flag.DurationVar(&robotTimeout, "robot-timeout", robotTimeout, "Deadline of a request to a robot")
+	flag.IntVar(&robotRetries, "robot-retries", robotRetries, "Number of retries of the idempotent requests to a robot")
+	var monitorInterval = flag.Duration("monitor-interval", 10*time.Second, "Interval between two checks of the robots (0 to disable)")
+	var courseFile = flag.String("course", "", "Course for the simulations (SVG drawing of the board or JSON file)")
+	flag.DurationVar(&leaseTime, "association-time", 0, "Default duration of an association of a robot with a card (0 for no limit)")
+	flag.IntVar(&leaseRuns, "association-runs", 0, "Default number of runs of an association of a robot with a card (0 for no limit)")
+	flag.DurationVar(&queueSlot, "queue-slot", queueSlot, "Expected time a card keeps a robot without a time limit (to estimate the wait in the queue)")
 
 	flag.Parse()
 
@@ -589,45 +564,114 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
+	if *storeSpec == "mongo" {
+		*storeSpec = "mongo:" + *mongoServer
+	}
+
 	var err error
-	mongoSession, err := mgo.Dial(*mongoServer)
+	store, err = openStore(*storeSpec, []byte(*secretKey), *domain)
 	if err != nil {
 		log.Fatal(err)
 	}
-	database = mongoSession.DB(dbName)
-	store = mongostore.NewMongoStore(
-		database.C(sessionC),
-		0, true, []byte(*secretKey))
+	codecs = securecookie.CodecsFromPairs([]byte(*secretKey))
+	log.Infof("Using store: %v", *storeSpec)
 
-	store.Options.Domain = *domain
+	if *actionsFile != "" {
+		catalog, err = program.LoadCatalog(*actionsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Action catalog loaded from %v", *actionsFile)
+	}
 
+	if *courseFile != "" {
+		course, err = sim.LoadCourse(*courseFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Course loaded from %v", *courseFile)
+	}
+
+	if *monitorInterval > 0 {
+		go monitorRobots(*monitorInterval)
+	}
+	go reapAssociations(reapInterval)
+
+	// The routes without role are open to the cards (kids), the routes of a
+	// card only to its owner and the staff
 	r := mux.NewRouter()
 
 	// Info
 	r.HandleFunc(prefix+"/info", GetInfo).Methods("GET")
+	r.HandleFunc(prefix+"/actions", GetActions).Methods("GET")
 
 	// Card management
-	r.HandleFunc(prefix+"/card/{cardId}", GetCard).Methods("GET")
-	r.HandleFunc(prefix+"/card/{cardId}", PutCard).Methods("PUT", "POST")
+	r.HandleFunc(prefix+"/card/{cardId}", requireCard(GetCard)).Methods("GET")
+	r.HandleFunc(prefix+"/card/{cardId}", requireCard(PutCard)).Methods("PUT", "POST")
+	r.HandleFunc(prefix+"/card/{cardId}/history", requireCard(GetHistory)).Methods("GET")
+	r.HandleFunc(prefix+"/card/{cardId}/history/{rev}", requireCard(GetRevision)).Methods("GET")
+	r.HandleFunc(prefix+"/card/{cardId}/restore/{rev}", requireCard(RestoreRevision)).Methods("PUT", "POST")
+	r.HandleFunc(prefix+"/card/{cardId}/simulate", requireCard(SimulateCard)).Methods("POST")
 
 	// Robot management
-	r.HandleFunc(prefix+"/robots", GetRobots).Methods("GET")
-	r.HandleFunc(prefix+"/robot/{robotName}", GetRobot).Methods("GET")
-	r.HandleFunc(prefix+"/robot/{robotName}", PutRobot).Methods("PUT", "POST")
-	r.HandleFunc(prefix+"/robot/{robotName}", DelRobot).Methods("DELETE")
-	r.HandleFunc(prefix+"/robot/{robotName}/ping", PingRobot).Methods("GET")
+	r.HandleFunc(prefix+"/robots", requireRole(RoleHelper, GetRobots)).Methods("GET")
+	r.HandleFunc(prefix+"/robot/{robotName}", requireRole(RoleHelper, GetRobot)).Methods("GET")
+	r.HandleFunc(prefix+"/robot/{robotName}", requireRole(RoleOrganizer, PutRobot)).Methods("PUT", "POST")
+	r.HandleFunc(prefix+"/robot/{robotName}", requireRole(RoleOrganizer, DelRobot)).Methods("DELETE")
+	r.HandleFunc(prefix+"/robot/{robotName}/ping", requireRole(RoleHelper, PingRobot)).Methods("GET")
+	r.HandleFunc(prefix+"/robot/{robotName}/state", requireRole(RoleHelper, GetRobotState)).Methods("GET")
+	r.HandleFunc(prefix+"/robot/{robotName}/calibrate/{calibration}", requireRole(RoleOperator, CalibrateRobot)).Methods("POST")
+	r.HandleFunc(prefix+"/robot/{robotName}/profile", requireRole(RoleHelper, GetRobotProfile)).Methods("GET")
+	r.HandleFunc(prefix+"/robot/{robotName}/profile", requireRole(RoleOperator, PutRobotProfile)).Methods("PUT", "POST")
+	r.HandleFunc(prefix+"/robot/{robotName}/profile/push", requireRole(RoleOperator, PushRobotProfile)).Methods("POST")
 
 	// Robot/Card associations
-	r.HandleFunc(prefix+"/robot/{robotName}/card/{cardId}", AssociateRobot).Methods("PUT", "POST")
-	r.HandleFunc(prefix+"/robot/{robotName}/card", DissociateRobot).Methods("DELETE")
+	r.HandleFunc(prefix+"/robot/{robotName}/card/{cardId}", requireRole(RoleHelper, AssociateRobot)).Methods("PUT", "POST")
+	r.HandleFunc(prefix+"/robot/{robotName}/card", requireRole(RoleHelper, DissociateRobot)).Methods("DELETE")
 
-	// Robot control
-	r.HandleFunc(prefix+"/card/{cardId}/ping", PingCardRobot).Methods("GET")
-	r.HandleFunc(prefix+"/card/{cardId}/run", RunCardRobot).Methods("GET")
-	r.HandleFunc(prefix+"/card/{cardId}/stop", StopCardRobot).Methods("GET")
-	r.HandleFunc(prefix+"/card/{cardId}/upload", UploadCardRobot).Methods("GET", "PUT", "POST")
+	// Queue
+	r.HandleFunc(prefix+"/card/{cardId}/queue", requireCard(JoinQueue)).Methods("POST")
+	r.HandleFunc(prefix+"/card/{cardId}/queue", requireCard(GetCardQueue)).Methods("GET")
+	r.HandleFunc(prefix+"/card/{cardId}/queue", requireCard(LeaveQueue)).Methods("DELETE")
+	r.HandleFunc(prefix+"/queue", requireRole(RoleHelper, GetQueue)).Methods("GET")
+	r.HandleFunc(prefix+"/queue/{cardId}/position/{position}", requireRole(RoleHelper, MoveInQueue)).Methods("PUT", "POST")
+	r.HandleFunc(prefix+"/queue/{cardId}/skip", requireRole(RoleHelper, SkipInQueue)).Methods("POST")
 
-	http.Handle("/", &CorsServer{r})
+	// Robot control
+	r.HandleFunc(prefix+"/card/{cardId}/ping", requireCard(PingCardRobot)).Methods("GET")
+	r.HandleFunc(prefix+"/card/{cardId}/run", requireCard(RunCardRobot)).Methods("GET")
+	r.HandleFunc(prefix+"/card/{cardId}/stop", requireCard(StopCardRobot)).Methods("GET")
+	r.HandleFunc(prefix+"/card/{cardId}/upload", requireCard(UploadCardRobot)).Methods("GET", "PUT", "POST")
+	r.HandleFunc(prefix+"/card/{cardId}/events", requireCard(GetCardEvents)).Methods("GET")
+	r.HandleFunc(prefix+"/card/{cardId}/event", requireCard(GetCardLastEvent)).Methods("GET")
+	r.HandleFunc(prefix+"/card/{cardId}/log", requireCard(GetLastRun)).Methods("GET")
+	r.HandleFunc(prefix+"/card/{cardId}/runs", requireCard(GetCardRuns)).Methods("GET")
+	r.HandleFunc(prefix+"/runs", requireRole(RoleHelper, GetRuns)).Methods("GET")
+
+	// Rounds
+	r.HandleFunc(prefix+"/card/{cardId}/round", requireRole(RoleHelper, StartRound)).Methods("POST")
+	r.HandleFunc(prefix+"/rounds", requireRole(RoleHelper, GetRounds)).Methods("GET")
+	r.HandleFunc(prefix+"/round/{roundId}", requireRole(RoleHelper, GetRound)).Methods("GET")
+	r.HandleFunc(prefix+"/round/{roundId}/result", requireRole(RoleHelper, PutRoundResult)).Methods("PUT", "POST")
+	r.HandleFunc(prefix+"/leaderboard", GetLeaderboard).Methods("GET")
+
+	// Revocation list
+	r.HandleFunc(prefix+"/revoked", requireRole(RoleOrganizer, GetRevocations)).Methods("GET")
+	r.HandleFunc(prefix+"/revoked/{token}", requireRole(RoleOrganizer, Revoke)).Methods("PUT", "POST")
+	r.HandleFunc(prefix+"/revoked/{token}", requireRole(RoleOrganizer, Unrevoke)).Methods("DELETE")
+
+	// Sessions and revocation list of the frontend
+	r.HandleFunc(prefix+"/session", GetSessionData).Methods("GET")
+	r.HandleFunc(prefix+"/session", PutSessionData).Methods("PUT", "POST")
+	r.HandleFunc(prefix+"/session", DelSessionData).Methods("DELETE")
+	r.HandleFunc(prefix+"/revoked/{token}", GetRevoked).Methods("GET")
+
+	// API tokens
+	r.HandleFunc(prefix+"/tokens", requireRole(RoleOrganizer, GetAPITokens)).Methods("GET")
+	r.HandleFunc(prefix+"/tokens", requireRole(RoleOrganizer, PostAPIToken)).Methods("POST")
+	r.HandleFunc(prefix+"/token/{tokenId}", requireRole(RoleOrganizer, DelAPIToken)).Methods("DELETE")
+
+	http.Handle("/", &CorsServer{r, *domain})
 
 	log.Infof("Ready, listening on port %d", *port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
@@ -0,0 +1,137 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Health is the status of a robot, as seen by the monitor.
+type Health struct {
+	Online   bool       `json:"online"`
+	Checked  time.Time  `json:"checked"`            // time of the last check
+	LastSeen *time.Time `json:"lastSeen,omitempty"` // time of the last answer
+	Latency  float64    `json:"latency"`            // ms, of the last answer
+	Running  bool       `json:"running"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// RobotStatus is a robot with its health.
+type RobotStatus struct {
+	Robot
+	Health *Health `json:"health,omitempty"`
+}
+
+// monitor periodically checks the robots with the "/state" method of the
+// firmware. The health is only kept in memory, the calibration is recorded in
+// the store.
+var monitor = struct {
+	sync.RWMutex
+	health map[string]Health
+}{health: make(map[string]Health)}
+
+// robotStatus returns a robot with its last known health.
+func robotStatus(robot Robot) RobotStatus {
+	monitor.RLock()
+	defer monitor.RUnlock()
+	s := RobotStatus{Robot: robot}
+	if h, ok := monitor.health[robot.Name]; ok {
+		s.Health = &h
+	}
+	return s
+}
+
+// monitorRobots checks all the robots every interval. It never returns.
+func monitorRobots(interval time.Duration) {
+	for {
+		checkRobots()
+		time.Sleep(interval)
+	}
+}
+
+// checkRobots checks all the robots in parallel, forgets the robots that were
+// removed and gives the free robots that are online to the queue.
+func checkRobots() {
+	robots, err := store.Robots()
+	if err != nil {
+		log.Errorf("Monitor: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, robot := range robots {
+		wg.Add(1)
+		go func(robot Robot) {
+			defer wg.Done()
+			checkRobot(robot)
+		}(robot)
+	}
+	wg.Wait()
+
+	monitor.Lock()
+	names := make(map[string]bool)
+	for _, robot := range robots {
+		names[robot.Name] = true
+	}
+	for name := range monitor.health {
+		if !names[name] {
+			delete(monitor.health, name)
+		}
+	}
+	monitor.Unlock()
+	dispatchQueue()
+}
+
+// checkRobot asks the state of a robot, records its health and its calibration
+// (if it changed).
+func checkRobot(robot Robot) {
+	c := robotClient(robot)
+	c.Retries = 0
+	start := time.Now()
+	state, err := c.State()
+
+	monitor.Lock()
+	h := monitor.health[robot.Name]
+	h.Checked = start
+	if err != nil {
+		if h.Online {
+			log.Warnf("Robot %v is offline: %v", robot.Name, err)
+		}
+		h.Online = false
+		h.Running = false
+		h.Error = err.Error()
+	} else {
+		if !h.Online {
+			log.Infof("Robot %v is online", robot.Name)
+		}
+		now := time.Now()
+		h.Online = true
+		h.LastSeen = &now
+		h.Latency = float64(now.Sub(start)) / float64(time.Millisecond)
+		h.Running = state.Running
+		h.Error = ""
+	}
+	monitor.health[robot.Name] = h
+	monitor.Unlock()
+
+	if err == nil && state.CmTime > 0 && state.AngleTime > 0 &&
+		(robot.Calibration == nil || *robot.Calibration != state.Calibration) {
+		err = store.SetRobotCalibration(robot.Name, state.Calibration, time.Time{})
+		if err != nil {
+			log.Errorf("Monitor: %v", err)
+		}
+	}
+}
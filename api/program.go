@@ -0,0 +1,81 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/BlueMasters/thymio-captain/program"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+)
+
+// JsonStepError is the error returned when a step of a program is invalid.
+type JsonStepError struct {
+	ErrorDescription string `json:"errorDescription"`
+	Step             int    `json:"step"`
+	Action           string `json:"action"`
+	Param            string `json:"param"`
+}
+
+// catalog is the list of the actions accepted in the programs. It can be
+// replaced by a configuration file (see the -actions flag).
+var catalog = program.DefaultCatalog
+
+// GetActions is the handler for the "GET /actions" method
+func GetActions(w http.ResponseWriter, r *http.Request) {
+	_, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(catalog)
+}
+
+// parseProgram decodes the program of a request payload and validates it
+// against the catalog. A missing program is an empty program. If the program is
+// not valid, it logs the error and returns it using HTTP (422 Unprocessable
+// Entity).
+func parseProgram(w http.ResponseWriter, data json.RawMessage) (p program.Program, err error) {
+	p = program.Program{}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &p)
+	}
+	if err == nil {
+		err = catalog.Validate(p)
+	}
+	reportProgram(w, err)
+	return
+}
+
+// checkProgram validates a program against the catalog. If the program is not
+// valid, it logs the error and returns it using HTTP (422 Unprocessable Entity).
+func checkProgram(w http.ResponseWriter, p program.Program) error {
+	return reportProgram(w, catalog.Validate(p))
+}
+
+// reportProgram checks the err argument and if not nil, it logs the error and
+// returns the error using HTTP (422 Unprocessable Entity).
+func reportProgram(w http.ResponseWriter, err error) error {
+	if err != nil {
+		var errorDesc []byte
+		if e, ok := err.(*program.StepError); ok {
+			errorDesc, _ = json.Marshal(JsonStepError{e.Error(), e.Index, e.Action, e.Param})
+		} else {
+			errorDesc, _ = json.Marshal(JsonError{err.Error()})
+		}
+		log.Info(err)
+		http.Error(w, string(errorDesc), 422)
+	}
+	return err
+}
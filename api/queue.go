@@ -0,0 +1,357 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// queueSlot is the expected time a card keeps a robot without a time limit. It
+// is used to estimate the waiting time.
+var queueSlot = 10 * time.Minute
+
+// QueueStatus is the place of a card in the queue. Position starts at 1 and
+// Wait is the estimated waiting time (seconds), unknown if no robot is online.
+// A card that left the queue because it got a robot has a position of 0.
+type QueueStatus struct {
+	CardId   string     `json:"cardId"`
+	Position int        `json:"position"`
+	Since    *time.Time `json:"since,omitempty"`
+	Wait     *float64   `json:"wait,omitempty"`
+	Robot    string     `json:"robot,omitempty"`
+}
+
+// queueEntry is a card waiting for a robot.
+type queueEntry struct {
+	cardId string
+	since  time.Time
+}
+
+// queue holds the cards waiting for a robot, first come first served. It is
+// only kept in memory. The first card gets the next free robot (see
+// dispatchQueue).
+var queue = struct {
+	sync.Mutex
+	entries []queueEntry
+}{}
+
+// errNotQueued is returned when a card is not in the queue.
+var errNotQueued = errors.New("Card not in queue")
+
+// queueIndex returns the index of a card in the queue, or -1. The caller holds
+// the lock.
+func queueIndex(cardId string) int {
+	for i, e := range queue.entries {
+		if e.cardId == cardId {
+			return i
+		}
+	}
+	return -1
+}
+
+// leaveQueue removes a card from the queue and returns false if it was not in
+// the queue.
+func leaveQueue(cardId string) bool {
+	queue.Lock()
+	defer queue.Unlock()
+	i := queueIndex(cardId)
+	if i < 0 {
+		return false
+	}
+	queue.entries = append(queue.entries[:i], queue.entries[i+1:]...)
+	return true
+}
+
+// onlineRobots returns the robots that are not known to be offline.
+func onlineRobots(robots []Robot) []Robot {
+	online := make([]Robot, 0, len(robots))
+	for _, robot := range robots {
+		if s := robotStatus(robot); s.Health == nil || s.Health.Online {
+			online = append(online, robot)
+		}
+	}
+	return online
+}
+
+// slotTime returns the expected time a card keeps a robot with the default
+// limits of the associations.
+func slotTime() time.Duration {
+	if leaseTime > 0 {
+		return leaseTime
+	}
+	return queueSlot
+}
+
+// freeIn returns the expected time until the robot is free: the rest of its
+// association when it is limited in time or in number of runs, a slot
+// otherwise.
+func freeIn(robot Robot) time.Duration {
+	if robot.CardId == "" {
+		return 0
+	}
+	lease := robot.Lease
+	if lease == nil || (lease.Expires == nil && lease.MaxRuns == 0) {
+		return queueSlot
+	}
+	d := queueSlot
+	if lease.Expires != nil {
+		d = lease.Expires.Sub(time.Now())
+	}
+	if lease.MaxRuns > 0 {
+		n, err := leaseRunsDone(robot)
+		if err != nil {
+			log.Errorf("Queue: %v", err)
+		} else if byRuns := queueSlot * time.Duration(lease.MaxRuns-n) / time.Duration(lease.MaxRuns); byRuns < d {
+			// the slot is shared by the runs of the association
+			d = byRuns
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// queueStatus returns the status of the cards in the queue. Every card gets the
+// robot that is free first, and keeps it for a slot.
+func queueStatus() ([]QueueStatus, error) {
+	robots, err := store.Robots()
+	if err != nil {
+		return nil, err
+	}
+	var free []time.Duration
+	for _, robot := range onlineRobots(robots) {
+		free = append(free, freeIn(robot))
+	}
+
+	queue.Lock()
+	defer queue.Unlock()
+	status := make([]QueueStatus, len(queue.entries))
+	for i, e := range queue.entries {
+		since := e.since
+		status[i] = QueueStatus{CardId: e.cardId, Position: i + 1, Since: &since}
+		if len(free) > 0 {
+			first := 0
+			for j := range free {
+				if free[j] < free[first] {
+					first = j
+				}
+			}
+			wait := free[first].Seconds()
+			status[i].Wait = &wait
+			free[first] += slotTime()
+		}
+	}
+	return status, nil
+}
+
+// cardQueueStatus returns the status of a card: its place in the queue or the
+// robot it got.
+func cardQueueStatus(cardId string) (QueueStatus, error) {
+	robot, err := store.RobotForCard(cardId)
+	if err == nil {
+		return QueueStatus{CardId: cardId, Robot: robot.Name}, nil
+	} else if err != ErrNotFound {
+		return QueueStatus{}, err
+	}
+	status, err := queueStatus()
+	if err != nil {
+		return QueueStatus{}, err
+	}
+	for _, s := range status {
+		if s.CardId == cardId {
+			return s, nil
+		}
+	}
+	return QueueStatus{}, errNotQueued
+}
+
+// dispatchQueue associates the free robots (that are not known to be offline)
+// with the first cards of the queue.
+func dispatchQueue() {
+	queue.Lock()
+	defer queue.Unlock()
+	if len(queue.entries) == 0 {
+		return
+	}
+	robots, err := store.Robots()
+	if err != nil {
+		log.Errorf("Queue: %v", err)
+		return
+	}
+	for _, robot := range onlineRobots(robots) {
+		if len(queue.entries) == 0 {
+			return
+		}
+		if robot.CardId != "" {
+			continue
+		}
+		cardId := queue.entries[0].cardId
+		lease, _ := newLease(nil)
+		err = store.SetRobotCard(robot.Name, cardId, lease)
+		if err != nil {
+			log.Errorf("Queue: %v", err)
+			continue
+		}
+		queue.entries = queue.entries[1:]
+		log.Infof("Queue: robot %v associated with card %v", robot.Name, cardId)
+		go syncCalibration(robot.Name)
+		publish(Event{Type: EventAssigned, CardId: cardId, Robot: robot.Name})
+	}
+}
+
+// JoinQueue is the handler for the "POST /card/{cardId}/queue" method. The card
+// waits for the next free robot. Joining the queue again keeps the position.
+func JoinQueue(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	cardId := vars["cardId"]
+	_, err = store.Card(cardId)
+	if err == ErrNotFound {
+		report(w, errors.New("Card not found"))
+		return
+	} else if report(w, err) != nil {
+		return
+	}
+	_, err = store.RobotForCard(cardId)
+	if err == nil {
+		report(w, errors.New("Robot already associated"))
+		return
+	} else if err != ErrNotFound {
+		report(w, err)
+		return
+	}
+
+	queue.Lock()
+	if queueIndex(cardId) < 0 {
+		queue.entries = append(queue.entries, queueEntry{cardId, time.Now()})
+		log.Infof("Queue: card %v is waiting (%d)", cardId, len(queue.entries))
+	}
+	queue.Unlock()
+	dispatchQueue()
+
+	status, err := cardQueueStatus(cardId)
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// GetCardQueue is the handler for the "GET /card/{cardId}/queue" method
+func GetCardQueue(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	status, err := cardQueueStatus(vars["cardId"])
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// LeaveQueue is the handler for the "DELETE /card/{cardId}/queue" method
+func LeaveQueue(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	if !leaveQueue(vars["cardId"]) {
+		report(w, errNotQueued)
+		return
+	}
+	json.NewEncoder(w).Encode(JsonOK{"done"})
+}
+
+// GetQueue is the handler for the "GET /queue" method
+func GetQueue(w http.ResponseWriter, r *http.Request) {
+	_, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	status, err := queueStatus()
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// MoveInQueue is the handler for the "PUT|POST /queue/{cardId}/position/{position}"
+// method. The card is moved to the given position (1 is the next card to get a
+// robot, a position after the end moves it at the end).
+func MoveInQueue(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	position, err := strconv.Atoi(vars["position"])
+	if err != nil || position < 1 {
+		report(w, errors.New("Invalid position"))
+		return
+	}
+
+	queue.Lock()
+	i := queueIndex(vars["cardId"])
+	if i < 0 {
+		queue.Unlock()
+		report(w, errNotQueued)
+		return
+	}
+	e := queue.entries[i]
+	entries := append(queue.entries[:i:i], queue.entries[i+1:]...)
+	if position > len(entries) {
+		position = len(entries) + 1
+	}
+	entries = append(entries[:position-1], append([]queueEntry{e}, entries[position-1:]...)...)
+	queue.entries = entries
+	queue.Unlock()
+	log.Infof("Queue: card %v moved to position %d", e.cardId, position)
+
+	status, err := queueStatus()
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// SkipInQueue is the handler for the "POST /queue/{cardId}/skip" method. The
+// card is removed from the queue (for example when the kid is not there when
+// the card gets a robot).
+func SkipInQueue(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	if !leaveQueue(vars["cardId"]) {
+		report(w, errNotQueued)
+		return
+	}
+	log.Infof("Queue: card %v skipped", vars["cardId"])
+	json.NewEncoder(w).Encode(JsonOK{"done"})
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Revocation is a revoked card (the token printed on the card). The frontend
+// refuses the revoked cards and the API ignores the sessions opened with them.
+type Revocation struct {
+	Token  string    `json:"token" bson:"token"`
+	Reason string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	Date   time.Time `json:"date" bson:"date"`
+	By     string    `json:"by" bson:"by"` // role of the staff member
+}
+
+// checkRevoked removes the privileges of a session opened with a revoked card:
+// the role of a staff card ("login") and the card of a kid ("cardId"). The
+// privileges are also removed when the revocation list cannot be read, and the
+// staff sessions without card (opened before the revocation list) lose their
+// role, since they cannot be revoked. The API tokens have no card.
+func checkRevoked(values map[interface{}]interface{}) {
+	if _, ok := values["token"]; !ok {
+		if login, _ := values["login"].(string); login == "" && sessionRole(values) != RoleKid {
+			log.Warnf("Staff session without card: %v", values["role"])
+			delete(values, "role")
+			delete(values, "admin")
+		}
+	}
+	for _, key := range []string{"login", "cardId"} {
+		token, ok := values[key].(string)
+		if !ok || token == "" {
+			continue
+		}
+		revoked, err := store.IsRevoked(token)
+		if err != nil {
+			log.Errorf("Revocation list: %v", err)
+		} else if revoked {
+			log.Warnf("Session opened with revoked card: %v", token)
+		} else {
+			continue
+		}
+		if key == "login" {
+			delete(values, "role")
+			delete(values, "admin")
+		}
+		delete(values, key)
+	}
+}
+
+// GetRevocations is the handler for the "GET /revoked" method
+func GetRevocations(w http.ResponseWriter, r *http.Request) {
+	_, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	revocations, err := store.Revocations()
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(revocations)
+}
+
+// Revoke is the handler for the "PUT|POST /revoked/{token}" method. The body
+// can give the reason ({"reason": "lost"}).
+func Revoke(w http.ResponseWriter, r *http.Request) {
+	vars, session, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		err = json.NewDecoder(r.Body).Decode(&payload)
+		if report(w, err) != nil {
+			return
+		}
+	}
+
+	err = store.Revoke(Revocation{
+		Token:  vars["token"],
+		Reason: payload.Reason,
+		Date:   time.Now(),
+		By:     sessionRole(session),
+	})
+	if report(w, err) != nil {
+		return
+	}
+	log.Warnf("Card revoked: %v (%v)", vars["token"], payload.Reason)
+	json.NewEncoder(w).Encode(JsonOK{"done"})
+}
+
+// Unrevoke is the handler for the "DELETE /revoked/{token}" method
+func Unrevoke(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	err = store.Unrevoke(vars["token"])
+	if report(w, err) != nil {
+		return
+	}
+	log.Infof("Card no longer revoked: %v", vars["token"])
+	json.NewEncoder(w).Encode(JsonOK{"done"})
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/BlueMasters/thymio-captain/robotclient"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+)
+
+// Settings of the robot clients (see the -robot-timeout and -robot-retries
+// flags).
+var (
+	robotTimeout = robotclient.DefaultTimeout
+	robotRetries = robotclient.DefaultRetries
+)
+
+// robotClient returns the client of a robot.
+func robotClient(robot Robot) *robotclient.Client {
+	c := robotclient.New(robot.URL)
+	c.Timeout = robotTimeout
+	c.Retries = robotRetries
+	return c
+}
+
+// reportRobot checks the err argument returned by a robot client and if not
+// nil, it logs the error and returns the error using HTTP, with the status code
+// of its kind.
+func reportRobot(w http.ResponseWriter, robot Robot, err error) error {
+	if e, ok := err.(*robotclient.Error); ok {
+		errorDesc, _ := json.Marshal(JsonError{e.Kind.String()})
+		log.Infof("Robot %v: %v", robot.Name, err)
+		http.Error(w, string(errorDesc), e.Kind.Status())
+		return err
+	}
+	return report(w, err)
+}
+
+// robotOK replies like the firmware when a robot command succeeded.
+func robotOK(w http.ResponseWriter) {
+	json.NewEncoder(w).Encode(JsonOK{"ok"})
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// Roles of the users, from the least to the most privileged. The role is
+// stored in the session ("role") by the card login of the frontend. Kids only
+// use their card, helpers manage the robots and the queue during the event,
+// operators also calibrate the robots and organizers register them.
+const (
+	RoleKid       = "kid"
+	RoleHelper    = "helper"
+	RoleOperator  = "operator"
+	RoleOrganizer = "organizer"
+)
+
+type contextKey int
+
+// sessionContextKey is the key of the session values in the context of a
+// request.
+const sessionContextKey contextKey = 0
+
+var roleLevels = map[string]int{
+	RoleKid:       0,
+	RoleHelper:    1,
+	RoleOperator:  2,
+	RoleOrganizer: 3,
+}
+
+// sessionRole returns the role of a session. A session without a known role
+// (for example a session created before the roles, with the admin flag only) is
+// a kid.
+func sessionRole(session map[interface{}]interface{}) string {
+	if role, ok := session["role"].(string); ok {
+		if _, ok := roleLevels[role]; ok {
+			return role
+		}
+	}
+	return RoleKid
+}
+
+// hasRole returns true if the role of the session is at least the given role.
+func hasRole(session map[interface{}]interface{}, role string) bool {
+	return roleLevels[sessionRole(session)] >= roleLevels[role]
+}
+
+// requireRole wraps a handler that requires at least the given role. A kid gets
+// the status 401 and a staff member without the role (or an API token
+// restricted to other robots) gets the status 403.
+func requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, session, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+		if !hasRole(session, role) {
+			have := sessionRole(session)
+			log.Warnf("Access denied: %v %v requires %v, session is %v", r.Method, r.URL.Path, role, have)
+			status := http.StatusForbidden
+			if have == RoleKid {
+				status = http.StatusUnauthorized
+			}
+			deny(w, status)
+			return
+		}
+		if !inScope(session, r) {
+			log.Warnf("Access denied: %v %v out of the robots of token %v", r.Method, r.URL.Path, session["token"])
+			deny(w, http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// requireCard wraps a handler of a card ("{cardId}" in the path). The card must
+// be the card of the session (the card used to open the frontend), unless the
+// session is a staff member. Otherwise the status is 403.
+func requireCard(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, session, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+		cardId := mux.Vars(r)["cardId"]
+		if owner, _ := session["cardId"].(string); owner != cardId && !hasRole(session, RoleHelper) {
+			log.Warnf("Access denied: %v %v from card %q (%v)", r.Method, r.URL.Path, owner, r.RemoteAddr)
+			deny(w, http.StatusForbidden)
+			return
+		}
+		if !inScope(session, r) {
+			log.Warnf("Access denied: %v %v out of the robots of token %v", r.Method, r.URL.Path, session["token"])
+			deny(w, http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// authenticate decodes the session of a request for the wrappers of the
+// routes. It returns the request carrying the session values, so that the
+// handler does not decode them again (see initSession). A session that cannot
+// be decoded (invalid API token or cookie) gets the status 401.
+func authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, map[interface{}]interface{}, bool) {
+	session, err := sessionValues(r)
+	if err != nil {
+		log.Warnf("Access denied: %v %v: %v", r.Method, r.URL.Path, err)
+		deny(w, http.StatusUnauthorized)
+		return r, nil, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey, session)), session, true
+}
+
+func deny(w http.ResponseWriter, status int) {
+	errorDesc, _ := json.Marshal(JsonError{"Not authorized"})
+	http.Error(w, string(errorDesc), status)
+}
@@ -0,0 +1,298 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Results of a round.
+const (
+	RoundSuccess = "success"
+	RoundFailure = "failure"
+)
+
+// Round is an attempt of a kid to win the challenge (grab the candy basket and
+// come back) with the program of a card. The round is open until the staff
+// marks it as a success or a failure. Duration is the time between the start and
+// the result (seconds).
+type Round struct {
+	Id       string     `json:"id" bson:"id"`
+	CardId   string     `json:"cardId" bson:"cardId"`
+	Robot    string     `json:"robot" bson:"robot"`
+	Start    time.Time  `json:"start" bson:"start"`
+	End      *time.Time `json:"end,omitempty" bson:"end,omitempty"`
+	Duration float64    `json:"duration" bson:"duration"`
+	Result   string     `json:"result,omitempty" bson:"result,omitempty"`
+	Score    int        `json:"score" bson:"score"`
+	Notes    string     `json:"notes,omitempty" bson:"notes,omitempty"`
+}
+
+// RoundResult is the body of the "PUT|POST /round/{roundId}/result" method.
+type RoundResult struct {
+	Success bool   `json:"success"`
+	Score   int    `json:"score"`
+	Notes   string `json:"notes"`
+}
+
+// LeaderboardEntry is the summary of the rounds of a card during a day. Best is
+// the best score and Fastest the duration of the fastest success. The card ID
+// opens the card (it is the token printed on it): the leaderboard is public, so
+// it only gives it to the staff and shows an alias to the others.
+type LeaderboardEntry struct {
+	Alias     string   `json:"alias"`
+	CardId    string   `json:"cardId,omitempty"`
+	Rounds    int      `json:"rounds"`
+	Successes int      `json:"successes"`
+	Best      int      `json:"best"`
+	Fastest   *float64 `json:"fastest,omitempty"`
+}
+
+// Leaderboard is the ranking of the cards during an event day.
+type Leaderboard struct {
+	Day     string             `json:"day"`
+	Entries []LeaderboardEntry `json:"entries"`
+}
+
+// timer updates the duration of an open round.
+func (round Round) timer() Round {
+	if round.End == nil {
+		round.Duration = seconds(time.Since(round.Start))
+	}
+	return round
+}
+
+// cardAlias returns the name of a card on the public leaderboard: a short hash
+// of its ID.
+func cardAlias(cardId string) string {
+	h := sha256.Sum256([]byte(cardId))
+	return hex.EncodeToString(h[:4])
+}
+
+func seconds(d time.Duration) float64 {
+	return float64(d/time.Millisecond) / 1000
+}
+
+// day parses the "day" parameter of a request (YYYY-MM-DD, today if missing) and
+// returns the start and the end of the day.
+func day(r *http.Request) (start time.Time, end time.Time, err error) {
+	s := r.URL.Query().Get("day")
+	if s == "" {
+		s = time.Now().Format("2006-01-02")
+	}
+	start, err = time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return start, end, fmt.Errorf("Invalid day: %v", s)
+	}
+	return start, start.AddDate(0, 0, 1), nil
+}
+
+// StartRound is the handler for the "POST /card/{cardId}/round" method. The
+// round starts for the card on the robot associated with it.
+func StartRound(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	robot, err := store.RobotForCard(vars["cardId"])
+	if report(w, err) != nil {
+		return
+	}
+	rounds, err := store.Rounds(vars["cardId"], time.Time{}, time.Now())
+	if report(w, err) != nil {
+		return
+	}
+	for _, round := range rounds {
+		if round.End == nil {
+			report(w, fmt.Errorf("Round %v is not over", round.Id))
+			return
+		}
+	}
+
+	now := time.Now()
+	round := Round{
+		Id:     fmt.Sprintf("%019d-%s", now.UnixNano(), vars["cardId"]),
+		CardId: vars["cardId"],
+		Robot:  robot.Name,
+		Start:  now,
+	}
+	err = store.PutRound(round)
+	if report(w, err) != nil {
+		return
+	}
+	log.Infof("Round %v started", round.Id)
+	json.NewEncoder(w).Encode(round)
+}
+
+// GetRound is the handler for the "GET /round/{roundId}" method
+func GetRound(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	round, err := store.Round(vars["roundId"])
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(round.timer())
+}
+
+// GetRounds is the handler for the "GET /rounds?day=" method. It returns the
+// rounds of an event day (today if missing), oldest first.
+func GetRounds(w http.ResponseWriter, r *http.Request) {
+	_, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	start, end, err := day(r)
+	if report(w, err) != nil {
+		return
+	}
+	rounds, err := store.Rounds("", start, end)
+	if report(w, err) != nil {
+		return
+	}
+	for i := range rounds {
+		rounds[i] = rounds[i].timer()
+	}
+	json.NewEncoder(w).Encode(rounds)
+}
+
+// PutRoundResult is the handler for the "PUT|POST /round/{roundId}/result"
+// method. It stops the timer of the round. The result of a round that is over
+// can be corrected, its duration is kept.
+func PutRoundResult(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	var result RoundResult
+	err = json.NewDecoder(r.Body).Decode(&result)
+	if report(w, err) != nil {
+		return
+	}
+	if result.Score < 0 {
+		report(w, errors.New("Invalid score"))
+		return
+	}
+
+	round, err := store.Round(vars["roundId"])
+	if report(w, err) != nil {
+		return
+	}
+	if round.End == nil {
+		now := time.Now()
+		round.End = &now
+		round.Duration = seconds(now.Sub(round.Start))
+	}
+	round.Result = RoundFailure
+	if result.Success {
+		round.Result = RoundSuccess
+	}
+	round.Score = result.Score
+	round.Notes = result.Notes
+	err = store.PutRound(round)
+	if report(w, err) != nil {
+		return
+	}
+	log.Infof("Round %v: %v (%d)", round.Id, round.Result, round.Score)
+	json.NewEncoder(w).Encode(round)
+}
+
+// byRank sorts the entries of a leaderboard: best score first, then fastest
+// success, then most successes.
+type byRank []LeaderboardEntry
+
+func (a byRank) Len() int      { return len(a) }
+func (a byRank) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byRank) Less(i, j int) bool {
+	if a[i].Best != a[j].Best {
+		return a[i].Best > a[j].Best
+	}
+	if (a[i].Fastest == nil) != (a[j].Fastest == nil) {
+		return a[i].Fastest != nil
+	}
+	if a[i].Fastest != nil && *a[i].Fastest != *a[j].Fastest {
+		return *a[i].Fastest < *a[j].Fastest
+	}
+	if a[i].Successes != a[j].Successes {
+		return a[i].Successes > a[j].Successes
+	}
+	return a[i].Alias < a[j].Alias
+}
+
+// GetLeaderboard is the handler for the "GET /leaderboard?day=" method. It
+// ranks the cards with the rounds of an event day (today if missing). The open
+// rounds are not counted. Only the staff gets the IDs of the cards.
+func GetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	_, session, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	start, end, err := day(r)
+	if report(w, err) != nil {
+		return
+	}
+	rounds, err := store.Rounds("", start, end)
+	if report(w, err) != nil {
+		return
+	}
+
+	entries := make(map[string]*LeaderboardEntry)
+	for _, round := range rounds {
+		if round.End == nil {
+			continue
+		}
+		e := entries[round.CardId]
+		if e == nil {
+			e = &LeaderboardEntry{Alias: cardAlias(round.CardId)}
+			if hasRole(session, RoleHelper) {
+				e.CardId = round.CardId
+			}
+			entries[round.CardId] = e
+		}
+		e.Rounds++
+		if round.Score > e.Best {
+			e.Best = round.Score
+		}
+		if round.Result == RoundSuccess {
+			e.Successes++
+			if e.Fastest == nil || round.Duration < *e.Fastest {
+				d := round.Duration
+				e.Fastest = &d
+			}
+		}
+	}
+
+	board := Leaderboard{Day: start.Format("2006-01-02"), Entries: make([]LeaderboardEntry, 0, len(entries))}
+	for _, e := range entries {
+		board.Entries = append(board.Entries, *e)
+	}
+	sort.Sort(byRank(board.Entries))
+	json.NewEncoder(w).Encode(board)
+}
@@ -0,0 +1,165 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BlueMasters/thymio-captain/sim"
+	"net/http"
+	"time"
+)
+
+// OutcomeLost is the outcome of a run when the API lost the contact with the
+// robot. The other outcomes are the ones of the sim package.
+const OutcomeLost = "lost"
+
+// Run is the execution of the program of a card by a robot, with the log of
+// its steps (as reported by the robot). Rev is the revision of the card uploaded
+// to the robot (0 if unknown) and StoppedBy tells who stopped the run through the API (the
+// role of the staff member or "card") or if the association was over
+// ("reaper").
+type Run struct {
+	Id        string           `json:"id" bson:"id"`
+	CardId    string           `json:"cardId" bson:"cardId"`
+	Robot     string           `json:"robot" bson:"robot"`
+	Rev       int              `json:"rev" bson:"rev"`
+	Start     time.Time        `json:"start" bson:"start"`
+	End       *time.Time       `json:"end,omitempty" bson:"end,omitempty"`
+	Outcome   string           `json:"outcome" bson:"outcome"`
+	StoppedBy string           `json:"stoppedBy,omitempty" bson:"stoppedBy,omitempty"`
+	Steps     []sim.StepResult `json:"steps" bson:"steps"`
+}
+
+// RunStats summarizes the runs of a card.
+type RunStats struct {
+	Runs     int            `json:"runs"`
+	Outcomes map[string]int `json:"outcomes"` // number of runs per outcome
+	First    time.Time      `json:"first"`
+	Last     time.Time      `json:"last"`
+}
+
+// CardRuns is the reply of the "GET /card/{cardId}/runs" method.
+type CardRuns struct {
+	Runs  []Run    `json:"runs"`
+	Stats RunStats `json:"stats"`
+}
+
+// AllRuns is the reply of the "GET /runs" method.
+type AllRuns struct {
+	Runs  []Run               `json:"runs"`
+	Cards map[string]RunStats `json:"cards"`
+}
+
+// newRun returns a run of the card starting now on the robot, with the
+// revision uploaded to the robot. The IDs of the runs are sorted by date.
+func newRun(cardId string, robot Robot) Run {
+	now := time.Now()
+	return Run{
+		Id:      fmt.Sprintf("%019d-%s", now.UnixNano(), cardId),
+		CardId:  cardId,
+		Robot:   robot.Name,
+		Rev:     robot.Rev,
+		Start:   now,
+		Outcome: sim.Running,
+		Steps:   []sim.StepResult{},
+	}
+}
+
+// runStats returns the statistics of the runs of each card.
+func runStats(runs []Run) map[string]RunStats {
+	stats := make(map[string]RunStats)
+	for _, run := range runs {
+		s, ok := stats[run.CardId]
+		if !ok {
+			s = RunStats{Outcomes: make(map[string]int), First: run.Start}
+		}
+		s.Runs++
+		s.Outcomes[run.Outcome]++
+		s.Last = run.Start
+		stats[run.CardId] = s
+	}
+	return stats
+}
+
+// stopper tells who sends a stop command.
+func stopper(session map[interface{}]interface{}) string {
+	if hasRole(session, RoleHelper) {
+		return sessionRole(session)
+	}
+	return "card"
+}
+
+// GetLastRun is the handler for the "GET /card/{cardId}/log" method. It returns
+// the execution log of the last run of the card.
+func GetLastRun(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	run, err := store.LastRun(vars["cardId"])
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(run)
+}
+
+// GetCardRuns is the handler for the "GET /card/{cardId}/runs" method. It
+// returns the runs of the card, oldest first, with their statistics.
+func GetCardRuns(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	runs, err := store.Runs(vars["cardId"], time.Time{})
+	if report(w, err) != nil {
+		return
+	}
+	stats, ok := runStats(runs)[vars["cardId"]]
+	if !ok {
+		stats.Outcomes = make(map[string]int)
+	}
+	json.NewEncoder(w).Encode(CardRuns{runs, stats})
+}
+
+// GetRuns is the handler for the "GET /runs?since=" method. It returns the runs
+// of all the cards started after since (RFC 3339 date or YYYY-MM-DD, all the
+// runs if missing), with the statistics of each card.
+func GetRuns(w http.ResponseWriter, r *http.Request) {
+	_, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			since, err = time.ParseInLocation("2006-01-02", s, time.Local)
+		}
+		if err != nil {
+			report(w, fmt.Errorf("Invalid date: %v", s))
+			return
+		}
+	}
+
+	runs, err := store.Runs("", since)
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(AllRuns{runs, runStats(runs)})
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/securecookie"
+	"net/http"
+)
+
+// SessionData is the body of the "/session" methods: the encoded values of a
+// session.
+type SessionData struct {
+	Data string `json:"data"`
+}
+
+// Revoked is the reply of the "GET /revoked/{token}" method.
+type Revoked struct {
+	Revoked bool `json:"revoked"`
+}
+
+// The "/session" methods keep the sessions of a frontend that does not share the
+// store of the API (BoltDB file). The session is given by the cookie in the
+// "Authorization: Cookie <cookie>" header and the values must be encoded with
+// the secret key: only the frontend can write them.
+
+// frontendSession returns the ID of the session of a "/session" method.
+func frontendSession(w http.ResponseWriter, r *http.Request) (string, error) {
+	store.Refresh()
+	w.Header().Set("Cache-Control", "max-age=0, no-cache, no-store")
+	id, err := cookieSessionID(r.Header.Get("Authorization"))
+	if err != nil {
+		log.Warnf("Access denied: %v %v: %v", r.Method, r.URL.Path, err)
+		deny(w, http.StatusUnauthorized)
+	}
+	return id, err
+}
+
+// GetSessionData is the handler for the "GET /session" method
+func GetSessionData(w http.ResponseWriter, r *http.Request) {
+	id, err := frontendSession(w, r)
+	if err != nil {
+		return
+	}
+
+	data, err := store.SessionData(id)
+	if err == ErrNotFound {
+		errorDesc, _ := json.Marshal(JsonError{"Session not found"})
+		http.Error(w, string(errorDesc), http.StatusNotFound)
+		return
+	} else if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(SessionData{data})
+}
+
+// PutSessionData is the handler for the "PUT|POST /session" method
+func PutSessionData(w http.ResponseWriter, r *http.Request) {
+	id, err := frontendSession(w, r)
+	if err != nil {
+		return
+	}
+
+	var payload SessionData
+	err = json.NewDecoder(r.Body).Decode(&payload)
+	if report(w, err) != nil {
+		return
+	}
+	var values map[interface{}]interface{}
+	err = securecookie.DecodeMulti(sessionKey, payload.Data, &values, codecs...)
+	if report(w, err) != nil {
+		return
+	}
+
+	err = store.PutSessionData(id, payload.Data)
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(JsonOK{"done"})
+}
+
+// DelSessionData is the handler for the "DELETE /session" method
+func DelSessionData(w http.ResponseWriter, r *http.Request) {
+	id, err := frontendSession(w, r)
+	if err != nil {
+		return
+	}
+
+	err = store.DelSessionData(id)
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(JsonOK{"done"})
+}
+
+// GetRevoked is the handler for the "GET /revoked/{token}" method. It tells the
+// frontend if a card is revoked; the caller already has the card.
+func GetRevoked(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	revoked, err := store.IsRevoked(vars["token"])
+	if report(w, err) != nil {
+		return
+	}
+	json.NewEncoder(w).Encode(Revoked{revoked})
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/BlueMasters/thymio-captain/sim"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+)
+
+// course is the board used by the simulations (see the -course flag). Without
+// a course, the programs are simulated on an empty floor.
+var course *sim.Course
+
+// SimulateCard is the handler for the "POST /card/{cardId}/simulate" method.
+// It executes the program of the card on the simulated course, without any
+// robot, with the calibration of the associated robot (see cardCalibration).
+func SimulateCard(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	card, err := store.Card(vars["cardId"])
+	if report(w, err) != nil {
+		return
+	}
+
+	if checkProgram(w, card.Program) != nil {
+		return
+	}
+
+	res := sim.Simulate(course, cardCalibration(card.CardId), card.Program)
+	log.Infof("Simulation of card %v: %v after %.1fs", card.CardId, res.Outcome, res.Duration)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BlueMasters/thymio-captain/sim"
+	"github.com/gorilla/sessions"
+	"strings"
+	"time"
+)
+
+// Names of the collections (or buckets) used by the stores.
+const (
+	cardC    = "cards"
+	robotC   = "robots"
+	historyC = "history"
+	runC     = "runs"
+	roundC   = "rounds"
+	revokedC = "revoked" // also checked by the frontend
+	tokenC   = "tokens"
+)
+
+// ErrNotFound is returned by a Store when the requested document does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Store is the persistence layer of the API. It holds the cards, the robots and
+// the sessions created by the frontend.
+type Store interface {
+	// Refresh is called at the beginning of every request.
+	Refresh()
+
+	// Card returns the card with the given ID or ErrNotFound.
+	Card(cardId string) (Card, error)
+	// PutCard creates or replaces a card.
+	PutCard(card Card) error
+
+	// AddRevision appends a revision to the history of a card. The revision
+	// number is assigned by the store and returned.
+	AddRevision(revision Revision) (int, error)
+	// Revisions returns the history of a card, oldest first.
+	Revisions(cardId string) ([]Revision, error)
+	// Revision returns one revision of a card or ErrNotFound.
+	Revision(cardId string, rev int) (Revision, error)
+
+	// PutRun creates or replaces a run.
+	PutRun(run Run) error
+	// LastRun returns the last run of a card or ErrNotFound.
+	LastRun(cardId string) (Run, error)
+	// Runs returns the runs of a card (of all cards if cardId is empty) started
+	// after since, oldest first.
+	Runs(cardId string, since time.Time) ([]Run, error)
+
+	// PutRound creates or replaces a round.
+	PutRound(round Round) error
+	// Round returns the round with the given ID or ErrNotFound.
+	Round(id string) (Round, error)
+	// Rounds returns the rounds of a card (of all cards if cardId is empty)
+	// started between start (included) and end (excluded), oldest first.
+	Rounds(cardId string, start time.Time, end time.Time) ([]Round, error)
+
+	// Revoke adds a card to the revocation list (or replaces its revocation).
+	Revoke(revocation Revocation) error
+	// Unrevoke removes a card from the revocation list or returns ErrNotFound.
+	Unrevoke(token string) error
+	// IsRevoked returns true if the card is in the revocation list.
+	IsRevoked(token string) (bool, error)
+	// Revocations returns the revocation list.
+	Revocations() ([]Revocation, error)
+
+	// PutAPIToken creates or replaces an API token.
+	PutAPIToken(token APIToken) error
+	// APIToken returns the API token with the given ID or ErrNotFound.
+	APIToken(id string) (APIToken, error)
+	// APITokens returns all the API tokens.
+	APITokens() ([]APIToken, error)
+	// DelAPIToken removes an API token or returns ErrNotFound.
+	DelAPIToken(id string) error
+	// TouchAPIToken records the last use of an API token, if it still exists.
+	TouchAPIToken(id string, date time.Time) error
+
+	// Robots returns all registered robots.
+	Robots() ([]Robot, error)
+	// Robot returns the robot with the given name or ErrNotFound.
+	Robot(name string) (Robot, error)
+	// RobotForCard returns the robot associated with the given card or ErrNotFound.
+	RobotForCard(cardId string) (Robot, error)
+	// PutRobot creates a robot or updates its URL. The card associated with an
+	// existing robot is kept.
+	PutRobot(name string, url string) error
+	// DelRobot removes a robot.
+	DelRobot(name string) error
+	// SetRobotCard associates a robot with a card, with the limits of the
+	// association, and forgets the revision uploaded to the robot. An empty
+	// cardId (and a nil lease) removes the association. It returns ErrNotFound
+	// if the robot does not exist.
+	SetRobotCard(name string, cardId string, lease *Lease) error
+	// SetRobotRev records the revision of the card uploaded to a robot. It
+	// returns ErrNotFound if the robot does not exist.
+	SetRobotRev(name string, rev int) error
+	// SetRobotCalibration records the calibration of a robot and, if date is
+	// not zero, the date of the calibration. It returns ErrNotFound if the
+	// robot does not exist.
+	SetRobotCalibration(name string, calibration sim.Calibration, date time.Time) error
+	// SetRobotProfile records the calibration profile of a robot. It returns
+	// ErrNotFound if the robot does not exist.
+	SetRobotProfile(name string, profile sim.Calibration) error
+
+	// Sessions returns the session store shared with the frontend.
+	Sessions() sessions.Store
+	// SessionData returns the encoded values of the session with the given ID
+	// or ErrNotFound.
+	SessionData(id string) (string, error)
+	// PutSessionData creates or replaces the encoded values of a session (for
+	// the frontend keeping its sessions through the API).
+	PutSessionData(id string, data string) error
+	// DelSessionData removes a session. Removing a missing session is not an
+	// error.
+	DelSessionData(id string) error
+}
+
+// openStore opens the store described by spec. The spec has the form
+// "kind[:argument]", for example "mongo:localhost", "bolt:/path/file.db" or
+// "memory".
+func openStore(spec string, secretKey []byte, domain string) (Store, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "mongo":
+		if arg == "" {
+			arg = "localhost"
+		}
+		return newMongoStore(arg, secretKey, domain)
+	case "bolt":
+		if arg == "" {
+			return nil, errors.New("Missing file name for the bolt store")
+		}
+		return newBoltStore(arg, secretKey, domain)
+	case "memory":
+		return newMemoryStore(secretKey, domain), nil
+	default:
+		return nil, fmt.Errorf("Unknown store: %v", kind)
+	}
+}
@@ -0,0 +1,460 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BlueMasters/thymio-captain/boltstore"
+	"github.com/BlueMasters/thymio-captain/sessionstore"
+	"github.com/BlueMasters/thymio-captain/sim"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/sessions"
+	"time"
+)
+
+// robotCardC is the index of the associations: the name of the robot of each
+// card.
+const robotCardC = "robotcards"
+
+// boltStore is the Store backed by a single BoltDB file, open as long as the
+// API runs. The frontend keeps its sessions through the API.
+type boltStore struct {
+	db       *boltstore.DB
+	backend  *boltstore.Sessions
+	sessions *sessionstore.Store
+}
+
+func newBoltStore(path string, secretKey []byte, domain string) (*boltStore, error) {
+	db, err := boltstore.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(indexRobotCards)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	b := &boltStore{db: db, backend: boltstore.NewSessions(db)}
+	b.sessions = sessionstore.New(b.backend, 0, secretKey)
+	b.sessions.Options.Domain = domain
+	return b, nil
+}
+
+// indexRobotCards builds the index of the associations from the robots (the
+// files written before the index do not have it).
+func indexRobotCards(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(robotCardC)) != nil {
+		if err := tx.DeleteBucket([]byte(robotCardC)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.CreateBucket([]byte(robotCardC)); err != nil {
+		return err
+	}
+	return boltstore.ForEach(tx, robotC, func(key string, data []byte) error {
+		var robot Robot
+		err := json.Unmarshal(data, &robot)
+		if err != nil || robot.CardId == "" {
+			return err
+		}
+		return boltstore.Put(tx, robotCardC, robot.CardId, robot.Name)
+	})
+}
+
+// boltError translates the "not found" error of the boltstore.
+func boltError(err error) error {
+	if err == boltstore.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (b *boltStore) Refresh() {}
+
+func (b *boltStore) Card(cardId string) (card Card, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.Get(tx, cardC, cardId, &card)
+	})
+	err = boltError(err)
+	return
+}
+
+func (b *boltStore) PutCard(card Card) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltstore.Put(tx, cardC, card.CardId, card)
+	})
+}
+
+// revisionKey returns the key of a revision. The revision number is padded so
+// that the keys of a card are sorted.
+func revisionKey(cardId string, rev int) string {
+	return fmt.Sprintf("%s/%08d", cardId, rev)
+}
+
+func (b *boltStore) AddRevision(revision Revision) (int, error) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		revision.Rev = 1
+		err := boltstore.ForEachPrefix(tx, historyC, revision.CardId+"/", func(key string, data []byte) error {
+			revision.Rev++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return boltstore.Put(tx, historyC, revisionKey(revision.CardId, revision.Rev), revision)
+	})
+	return revision.Rev, err
+}
+
+func (b *boltStore) Revisions(cardId string) (revisions []Revision, err error) {
+	revisions = make([]Revision, 0)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.ForEachPrefix(tx, historyC, cardId+"/", func(key string, data []byte) error {
+			var revision Revision
+			err := json.Unmarshal(data, &revision)
+			revisions = append(revisions, revision)
+			return err
+		})
+	})
+	return
+}
+
+func (b *boltStore) Revision(cardId string, rev int) (revision Revision, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.Get(tx, historyC, revisionKey(cardId, rev), &revision)
+	})
+	err = boltError(err)
+	return
+}
+
+func (b *boltStore) PutRun(run Run) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltstore.Put(tx, runC, run.Id, run)
+	})
+}
+
+func (b *boltStore) LastRun(cardId string) (last Run, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		found := false
+		err := boltstore.ForEach(tx, runC, func(key string, data []byte) error {
+			var run Run
+			err := json.Unmarshal(data, &run)
+			if err == nil && run.CardId == cardId {
+				last, found = run, true
+			}
+			return err
+		})
+		if err == nil && !found {
+			err = ErrNotFound
+		}
+		return err
+	})
+	return
+}
+
+func (b *boltStore) Runs(cardId string, since time.Time) (runs []Run, err error) {
+	runs = make([]Run, 0)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.ForEach(tx, runC, func(key string, data []byte) error {
+			var run Run
+			err := json.Unmarshal(data, &run)
+			if err == nil && (cardId == "" || run.CardId == cardId) && !run.Start.Before(since) {
+				runs = append(runs, run)
+			}
+			return err
+		})
+	})
+	return
+}
+
+func (b *boltStore) PutRound(round Round) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltstore.Put(tx, roundC, round.Id, round)
+	})
+}
+
+func (b *boltStore) Round(id string) (round Round, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.Get(tx, roundC, id, &round)
+	})
+	err = boltError(err)
+	return
+}
+
+func (b *boltStore) Rounds(cardId string, start time.Time, end time.Time) (rounds []Round, err error) {
+	rounds = make([]Round, 0)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.ForEach(tx, roundC, func(key string, data []byte) error {
+			var round Round
+			err := json.Unmarshal(data, &round)
+			if err == nil && (cardId == "" || round.CardId == cardId) &&
+				!round.Start.Before(start) && round.Start.Before(end) {
+				rounds = append(rounds, round)
+			}
+			return err
+		})
+	})
+	return
+}
+
+func (b *boltStore) Revoke(revocation Revocation) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltstore.Put(tx, revokedC, revocation.Token, revocation)
+	})
+}
+
+func (b *boltStore) Unrevoke(token string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var revocation Revocation
+		err := boltstore.Get(tx, revokedC, token, &revocation)
+		if err != nil {
+			return err
+		}
+		return boltstore.Delete(tx, revokedC, token)
+	})
+	return boltError(err)
+}
+
+func (b *boltStore) IsRevoked(token string) (bool, error) {
+	var revocation Revocation
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.Get(tx, revokedC, token, &revocation)
+	})
+	if err == boltstore.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *boltStore) Revocations() (revocations []Revocation, err error) {
+	revocations = make([]Revocation, 0)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.ForEach(tx, revokedC, func(key string, data []byte) error {
+			var revocation Revocation
+			err := json.Unmarshal(data, &revocation)
+			revocations = append(revocations, revocation)
+			return err
+		})
+	})
+	return
+}
+
+func (b *boltStore) PutAPIToken(token APIToken) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltstore.Put(tx, tokenC, token.Id, token)
+	})
+}
+
+func (b *boltStore) APIToken(id string) (token APIToken, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.Get(tx, tokenC, id, &token)
+	})
+	err = boltError(err)
+	return
+}
+
+func (b *boltStore) APITokens() (tokens []APIToken, err error) {
+	tokens = make([]APIToken, 0)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.ForEach(tx, tokenC, func(key string, data []byte) error {
+			var token APIToken
+			err := json.Unmarshal(data, &token)
+			tokens = append(tokens, token)
+			return err
+		})
+	})
+	return
+}
+
+func (b *boltStore) DelAPIToken(id string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var token APIToken
+		err := boltstore.Get(tx, tokenC, id, &token)
+		if err != nil {
+			return err
+		}
+		return boltstore.Delete(tx, tokenC, id)
+	})
+	return boltError(err)
+}
+
+func (b *boltStore) TouchAPIToken(id string, date time.Time) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var token APIToken
+		err := boltstore.Get(tx, tokenC, id, &token)
+		if err != nil {
+			return err
+		}
+		token.LastUsed = &date
+		return boltstore.Put(tx, tokenC, id, token)
+	})
+	return boltError(err)
+}
+
+func (b *boltStore) Robots() (robots []Robot, err error) {
+	robots = make([]Robot, 0)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.ForEach(tx, robotC, func(key string, data []byte) error {
+			var robot Robot
+			err := json.Unmarshal(data, &robot)
+			robots = append(robots, robot)
+			return err
+		})
+	})
+	return
+}
+
+func (b *boltStore) Robot(name string) (robot Robot, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return boltstore.Get(tx, robotC, name, &robot)
+	})
+	err = boltError(err)
+	return
+}
+
+func (b *boltStore) RobotForCard(cardId string) (robot Robot, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		var name string
+		err := boltstore.Get(tx, robotCardC, cardId, &name)
+		if err != nil {
+			return err
+		}
+		return boltstore.Get(tx, robotC, name, &robot)
+	})
+	err = boltError(err)
+	return
+}
+
+func (b *boltStore) PutRobot(name string, url string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var robot Robot
+		err := boltstore.Get(tx, robotC, name, &robot)
+		if err != nil && err != boltstore.ErrNotFound {
+			return err
+		}
+		robot.Name = name
+		robot.URL = url
+		return boltstore.Put(tx, robotC, name, robot)
+	})
+}
+
+func (b *boltStore) DelRobot(name string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var robot Robot
+		err := boltstore.Get(tx, robotC, name, &robot)
+		if err == boltstore.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if robot.CardId != "" {
+			err = boltstore.Delete(tx, robotCardC, robot.CardId)
+			if err != nil {
+				return err
+			}
+		}
+		return boltstore.Delete(tx, robotC, name)
+	})
+}
+
+func (b *boltStore) SetRobotCard(name string, cardId string, lease *Lease) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var robot Robot
+		err := boltstore.Get(tx, robotC, name, &robot)
+		if err != nil {
+			return err
+		}
+		if robot.CardId != "" {
+			err = boltstore.Delete(tx, robotCardC, robot.CardId)
+			if err != nil {
+				return err
+			}
+		}
+		if cardId != "" {
+			err = boltstore.Put(tx, robotCardC, cardId, name)
+			if err != nil {
+				return err
+			}
+		}
+		robot.CardId = cardId
+		robot.Lease = lease
+		robot.Rev = 0
+		return boltstore.Put(tx, robotC, name, robot)
+	})
+	return boltError(err)
+}
+
+func (b *boltStore) SetRobotRev(name string, rev int) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var robot Robot
+		err := boltstore.Get(tx, robotC, name, &robot)
+		if err != nil {
+			return err
+		}
+		robot.Rev = rev
+		return boltstore.Put(tx, robotC, name, robot)
+	})
+	return boltError(err)
+}
+
+func (b *boltStore) SetRobotCalibration(name string, calibration sim.Calibration, date time.Time) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var robot Robot
+		err := boltstore.Get(tx, robotC, name, &robot)
+		if err != nil {
+			return err
+		}
+		robot.Calibration = &calibration
+		if !date.IsZero() {
+			robot.Calibrated = &date
+		}
+		return boltstore.Put(tx, robotC, name, robot)
+	})
+	return boltError(err)
+}
+
+func (b *boltStore) SetRobotProfile(name string, profile sim.Calibration) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var robot Robot
+		err := boltstore.Get(tx, robotC, name, &robot)
+		if err != nil {
+			return err
+		}
+		robot.Profile = &profile
+		return boltstore.Put(tx, robotC, name, robot)
+	})
+	return boltError(err)
+}
+
+func (b *boltStore) Sessions() sessions.Store {
+	return b.sessions
+}
+
+func (b *boltStore) SessionData(id string) (string, error) {
+	data, err := b.backend.Load(id)
+	if err == sessionstore.ErrNotFound {
+		err = ErrNotFound
+	}
+	return data, err
+}
+
+func (b *boltStore) PutSessionData(id string, data string) error {
+	return b.backend.Save(id, data)
+}
+
+func (b *boltStore) DelSessionData(id string) error {
+	return b.backend.Delete(id)
+}
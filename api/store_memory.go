@@ -0,0 +1,383 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/BlueMasters/thymio-captain/sessionstore"
+	"github.com/BlueMasters/thymio-captain/sim"
+	"github.com/gorilla/sessions"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps everything in memory. It is meant for
+// development and for testing the handlers without a database.
+type memoryStore struct {
+	mu       sync.RWMutex
+	cards    map[string]Card
+	history  map[string][]Revision
+	runs     map[string]Run
+	rounds   map[string]Round
+	revoked  map[string]Revocation
+	tokens   map[string]APIToken
+	robots   map[string]Robot
+	backend  *sessionstore.Memory
+	sessions *sessionstore.Store
+}
+
+func newMemoryStore(secretKey []byte, domain string) *memoryStore {
+	m := &memoryStore{
+		cards:   make(map[string]Card),
+		history: make(map[string][]Revision),
+		runs:    make(map[string]Run),
+		rounds:  make(map[string]Round),
+		revoked: make(map[string]Revocation),
+		tokens:  make(map[string]APIToken),
+		robots:  make(map[string]Robot),
+		backend: sessionstore.NewMemory(),
+	}
+	m.sessions = sessionstore.New(m.backend, 0, secretKey)
+	m.sessions.Options.Domain = domain
+	return m
+}
+
+func (m *memoryStore) Refresh() {}
+
+func (m *memoryStore) Card(cardId string) (Card, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	card, ok := m.cards[cardId]
+	if !ok {
+		return card, ErrNotFound
+	}
+	return card, nil
+}
+
+func (m *memoryStore) PutCard(card Card) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cards[card.CardId] = card
+	return nil
+}
+
+func (m *memoryStore) AddRevision(revision Revision) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	revision.Rev = len(m.history[revision.CardId]) + 1
+	m.history[revision.CardId] = append(m.history[revision.CardId], revision)
+	return revision.Rev, nil
+}
+
+func (m *memoryStore) Revisions(cardId string) ([]Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Revision{}, m.history[cardId]...), nil
+}
+
+func (m *memoryStore) Revision(cardId string, rev int) (Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	history := m.history[cardId]
+	if rev < 1 || rev > len(history) {
+		return Revision{}, ErrNotFound
+	}
+	return history[rev-1], nil
+}
+
+func (m *memoryStore) PutRun(run Run) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs[run.Id] = run
+	return nil
+}
+
+func (m *memoryStore) LastRun(cardId string) (last Run, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	err = ErrNotFound
+	for _, run := range m.runs {
+		if run.CardId == cardId && (err != nil || run.Id > last.Id) {
+			last, err = run, nil
+		}
+	}
+	return
+}
+
+func (m *memoryStore) Runs(cardId string, since time.Time) ([]Run, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	runs := make([]Run, 0)
+	for _, run := range m.runs {
+		if (cardId == "" || run.CardId == cardId) && !run.Start.Before(since) {
+			runs = append(runs, run)
+		}
+	}
+	sort.Sort(byId(runs))
+	return runs, nil
+}
+
+func (m *memoryStore) PutRound(round Round) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rounds[round.Id] = round
+	return nil
+}
+
+func (m *memoryStore) Round(id string) (Round, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	round, ok := m.rounds[id]
+	if !ok {
+		return round, ErrNotFound
+	}
+	return round, nil
+}
+
+func (m *memoryStore) Rounds(cardId string, start time.Time, end time.Time) ([]Round, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rounds := make([]Round, 0)
+	for _, round := range m.rounds {
+		if (cardId == "" || round.CardId == cardId) && !round.Start.Before(start) && round.Start.Before(end) {
+			rounds = append(rounds, round)
+		}
+	}
+	sort.Sort(byRoundId(rounds))
+	return rounds, nil
+}
+
+func (m *memoryStore) Revoke(revocation Revocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revoked[revocation.Token] = revocation
+	return nil
+}
+
+func (m *memoryStore) Unrevoke(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.revoked[token]; !ok {
+		return ErrNotFound
+	}
+	delete(m.revoked, token)
+	return nil
+}
+
+func (m *memoryStore) IsRevoked(token string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.revoked[token]
+	return ok, nil
+}
+
+func (m *memoryStore) Revocations() ([]Revocation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	revocations := make([]Revocation, 0, len(m.revoked))
+	for _, revocation := range m.revoked {
+		revocations = append(revocations, revocation)
+	}
+	return revocations, nil
+}
+
+func (m *memoryStore) PutAPIToken(token APIToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[token.Id] = token
+	return nil
+}
+
+func (m *memoryStore) APIToken(id string) (APIToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	token, ok := m.tokens[id]
+	if !ok {
+		return token, ErrNotFound
+	}
+	return token, nil
+}
+
+func (m *memoryStore) APITokens() ([]APIToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tokens := make([]APIToken, 0, len(m.tokens))
+	for _, token := range m.tokens {
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (m *memoryStore) DelAPIToken(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tokens[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.tokens, id)
+	return nil
+}
+
+func (m *memoryStore) TouchAPIToken(id string, date time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.tokens[id]
+	if !ok {
+		return ErrNotFound
+	}
+	token.LastUsed = &date
+	m.tokens[id] = token
+	return nil
+}
+
+func (m *memoryStore) Robots() ([]Robot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	robots := make([]Robot, 0, len(m.robots))
+	for _, robot := range m.robots {
+		robots = append(robots, robot)
+	}
+	sort.Sort(byName(robots))
+	return robots, nil
+}
+
+func (m *memoryStore) Robot(name string) (Robot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	robot, ok := m.robots[name]
+	if !ok {
+		return robot, ErrNotFound
+	}
+	return robot, nil
+}
+
+func (m *memoryStore) RobotForCard(cardId string) (Robot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, robot := range m.robots {
+		if robot.CardId == cardId {
+			return robot, nil
+		}
+	}
+	return Robot{}, ErrNotFound
+}
+
+func (m *memoryStore) PutRobot(name string, url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	robot := m.robots[name]
+	robot.Name = name
+	robot.URL = url
+	m.robots[name] = robot
+	return nil
+}
+
+func (m *memoryStore) DelRobot(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.robots, name)
+	return nil
+}
+
+func (m *memoryStore) SetRobotCard(name string, cardId string, lease *Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	robot, ok := m.robots[name]
+	if !ok {
+		return ErrNotFound
+	}
+	robot.CardId = cardId
+	robot.Lease = lease
+	robot.Rev = 0
+	m.robots[name] = robot
+	return nil
+}
+
+func (m *memoryStore) SetRobotRev(name string, rev int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	robot, ok := m.robots[name]
+	if !ok {
+		return ErrNotFound
+	}
+	robot.Rev = rev
+	m.robots[name] = robot
+	return nil
+}
+
+func (m *memoryStore) SetRobotCalibration(name string, calibration sim.Calibration, date time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	robot, ok := m.robots[name]
+	if !ok {
+		return ErrNotFound
+	}
+	robot.Calibration = &calibration
+	if !date.IsZero() {
+		robot.Calibrated = &date
+	}
+	m.robots[name] = robot
+	return nil
+}
+
+func (m *memoryStore) SetRobotProfile(name string, profile sim.Calibration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	robot, ok := m.robots[name]
+	if !ok {
+		return ErrNotFound
+	}
+	robot.Profile = &profile
+	m.robots[name] = robot
+	return nil
+}
+
+func (m *memoryStore) Sessions() sessions.Store {
+	return m.sessions
+}
+
+func (m *memoryStore) SessionData(id string) (string, error) {
+	data, err := m.backend.Load(id)
+	if err == sessionstore.ErrNotFound {
+		err = ErrNotFound
+	}
+	return data, err
+}
+
+func (m *memoryStore) PutSessionData(id string, data string) error {
+	return m.backend.Save(id, data)
+}
+
+func (m *memoryStore) DelSessionData(id string) error {
+	return m.backend.Delete(id)
+}
+
+type byName []Robot
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+type byId []Run
+
+func (a byId) Len() int           { return len(a) }
+func (a byId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byId) Less(i, j int) bool { return a[i].Id < a[j].Id }
+
+type byRoundId []Round
+
+func (a byRoundId) Len() int           { return len(a) }
+func (a byRoundId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byRoundId) Less(i, j int) bool { return a[i].Id < a[j].Id }
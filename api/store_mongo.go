@@ -0,0 +1,312 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"github.com/BlueMasters/thymio-captain/sim"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/sessions"
+	"github.com/kidstuff/mongostore"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+const (
+	dbName   = "thymio_captain"
+	sessionC = "sessions"
+)
+
+// cardVersion is the version of the card documents. The cards of version 0
+// hold their program as binary JSON; they are migrated when they are read.
+const cardVersion = 1
+
+// revisionRetries is the number of attempts to number a revision.
+const revisionRetries = 5
+
+// mongoCard is the document stored for each card.
+type mongoCard struct {
+	Card    `bson:",inline"`
+	Version int `bson:"version"`
+}
+
+// mongoStore is the MongoDB implementation of the Store.
+type mongoStore struct {
+	database *mgo.Database
+	sessions *mongostore.MongoStore
+}
+
+func newMongoStore(server string, secretKey []byte, domain string) (*mongoStore, error) {
+	mongoSession, err := mgo.Dial(server)
+	if err != nil {
+		return nil, err
+	}
+	m := &mongoStore{database: mongoSession.DB(dbName)}
+	err = m.database.C(historyC).EnsureIndex(mgo.Index{Key: []string{"cardId", "rev"}, Unique: true})
+	if err != nil {
+		log.Errorf("Index of the history: %v", err)
+	}
+	m.sessions = mongostore.NewMongoStore(m.database.C(sessionC), 0, true, secretKey)
+	m.sessions.Options.Domain = domain
+	return m, nil
+}
+
+// mongoError translates the "not found" error of mgo.
+func mongoError(err error) error {
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (m *mongoStore) Refresh() {
+	m.database.Session.Refresh()
+}
+
+func (m *mongoStore) Card(cardId string) (Card, error) {
+	var doc mongoCard
+	err := m.database.C(cardC).Find(bson.M{"cardId": cardId}).One(&doc)
+	if err == nil && doc.Version < cardVersion {
+		log.Infof("Migrating card %v to version %d", cardId, cardVersion)
+		err = m.PutCard(doc.Card)
+	}
+	return doc.Card, mongoError(err)
+}
+
+func (m *mongoStore) PutCard(card Card) error {
+	_, err := m.database.C(cardC).Upsert(bson.M{"cardId": card.CardId}, mongoCard{card, cardVersion})
+	return err
+}
+
+// AddRevision numbers the revision after the last one of the card. The unique
+// index of the history refuses a number taken by a concurrent save, the number
+// is then taken again.
+func (m *mongoStore) AddRevision(revision Revision) (int, error) {
+	var err error
+	for i := 0; i < revisionRetries; i++ {
+		var last Revision
+		err = m.database.C(historyC).Find(bson.M{"cardId": revision.CardId}).Sort("-rev").One(&last)
+		if err != nil && err != mgo.ErrNotFound {
+			return 0, err
+		}
+		revision.Rev = last.Rev + 1
+		err = m.database.C(historyC).Insert(revision)
+		if !mgo.IsDup(err) {
+			return revision.Rev, err
+		}
+		log.Infof("Revision %d of card %v already taken", revision.Rev, revision.CardId)
+	}
+	return 0, err
+}
+
+func (m *mongoStore) Revisions(cardId string) (revisions []Revision, err error) {
+	revisions = make([]Revision, 0)
+	err = m.database.C(historyC).Find(bson.M{"cardId": cardId}).Sort("rev").All(&revisions)
+	return
+}
+
+func (m *mongoStore) Revision(cardId string, rev int) (revision Revision, err error) {
+	err = m.database.C(historyC).Find(bson.M{"cardId": cardId, "rev": rev}).One(&revision)
+	err = mongoError(err)
+	return
+}
+
+func (m *mongoStore) PutRun(run Run) error {
+	_, err := m.database.C(runC).Upsert(bson.M{"id": run.Id}, run)
+	return err
+}
+
+func (m *mongoStore) LastRun(cardId string) (run Run, err error) {
+	err = m.database.C(runC).Find(bson.M{"cardId": cardId}).Sort("-id").One(&run)
+	err = mongoError(err)
+	return
+}
+
+func (m *mongoStore) Runs(cardId string, since time.Time) (runs []Run, err error) {
+	query := bson.M{"start": bson.M{"$gte": since}}
+	if cardId != "" {
+		query["cardId"] = cardId
+	}
+	runs = make([]Run, 0)
+	err = m.database.C(runC).Find(query).Sort("id").All(&runs)
+	return
+}
+
+func (m *mongoStore) PutRound(round Round) error {
+	_, err := m.database.C(roundC).Upsert(bson.M{"id": round.Id}, round)
+	return err
+}
+
+func (m *mongoStore) Round(id string) (round Round, err error) {
+	err = m.database.C(roundC).Find(bson.M{"id": id}).One(&round)
+	err = mongoError(err)
+	return
+}
+
+func (m *mongoStore) Rounds(cardId string, start time.Time, end time.Time) (rounds []Round, err error) {
+	query := bson.M{"start": bson.M{"$gte": start, "$lt": end}}
+	if cardId != "" {
+		query["cardId"] = cardId
+	}
+	rounds = make([]Round, 0)
+	err = m.database.C(roundC).Find(query).Sort("id").All(&rounds)
+	return
+}
+
+func (m *mongoStore) Revoke(revocation Revocation) error {
+	_, err := m.database.C(revokedC).Upsert(bson.M{"token": revocation.Token}, revocation)
+	return err
+}
+
+func (m *mongoStore) Unrevoke(token string) error {
+	err := m.database.C(revokedC).Remove(bson.M{"token": token})
+	return mongoError(err)
+}
+
+func (m *mongoStore) IsRevoked(token string) (bool, error) {
+	n, err := m.database.C(revokedC).Find(bson.M{"token": token}).Count()
+	return n > 0, err
+}
+
+func (m *mongoStore) Revocations() (revocations []Revocation, err error) {
+	revocations = make([]Revocation, 0)
+	err = m.database.C(revokedC).Find(nil).Sort("date").All(&revocations)
+	return
+}
+
+func (m *mongoStore) PutAPIToken(token APIToken) error {
+	_, err := m.database.C(tokenC).Upsert(bson.M{"id": token.Id}, token)
+	return err
+}
+
+func (m *mongoStore) APIToken(id string) (token APIToken, err error) {
+	err = m.database.C(tokenC).Find(bson.M{"id": id}).One(&token)
+	err = mongoError(err)
+	return
+}
+
+func (m *mongoStore) APITokens() (tokens []APIToken, err error) {
+	tokens = make([]APIToken, 0)
+	err = m.database.C(tokenC).Find(nil).Sort("created").All(&tokens)
+	return
+}
+
+func (m *mongoStore) DelAPIToken(id string) error {
+	err := m.database.C(tokenC).Remove(bson.M{"id": id})
+	return mongoError(err)
+}
+
+func (m *mongoStore) TouchAPIToken(id string, date time.Time) error {
+	err := m.database.C(tokenC).Update(bson.M{"id": id}, bson.M{"$set": bson.M{"lastUsed": date}})
+	return mongoError(err)
+}
+
+func (m *mongoStore) Robots() (robots []Robot, err error) {
+	err = m.database.C(robotC).Find(nil).All(&robots)
+	return
+}
+
+func (m *mongoStore) Robot(name string) (robot Robot, err error) {
+	err = m.database.C(robotC).Find(bson.M{"name": name}).One(&robot)
+	err = mongoError(err)
+	return
+}
+
+func (m *mongoStore) RobotForCard(cardId string) (robot Robot, err error) {
+	err = m.database.C(robotC).Find(bson.M{"cardId": cardId}).One(&robot)
+	err = mongoError(err)
+	return
+}
+
+func (m *mongoStore) PutRobot(name string, url string) error {
+	_, err := m.database.C(robotC).Upsert(
+		bson.M{"name": name},
+		bson.M{
+			"$set":         bson.M{"url": url},
+			"$setOnInsert": bson.M{"cardId": ""}})
+	return err
+}
+
+func (m *mongoStore) DelRobot(name string) error {
+	_, err := m.database.C(robotC).RemoveAll(bson.M{"name": name})
+	return err
+}
+
+func (m *mongoStore) SetRobotCard(name string, cardId string, lease *Lease) error {
+	update := bson.M{"$set": bson.M{"cardId": cardId, "lease": lease}, "$unset": bson.M{"rev": ""}}
+	if lease == nil {
+		update = bson.M{"$set": bson.M{"cardId": cardId}, "$unset": bson.M{"lease": "", "rev": ""}}
+	}
+	err := m.database.C(robotC).Update(bson.M{"name": name}, update)
+	return mongoError(err)
+}
+
+func (m *mongoStore) SetRobotRev(name string, rev int) error {
+	err := m.database.C(robotC).Update(bson.M{"name": name}, bson.M{"$set": bson.M{"rev": rev}})
+	return mongoError(err)
+}
+
+func (m *mongoStore) SetRobotCalibration(name string, calibration sim.Calibration, date time.Time) error {
+	set := bson.M{"calibration": calibration}
+	if !date.IsZero() {
+		set["calibrated"] = date
+	}
+	err := m.database.C(robotC).Update(bson.M{"name": name}, bson.M{"$set": set})
+	return mongoError(err)
+}
+
+func (m *mongoStore) SetRobotProfile(name string, profile sim.Calibration) error {
+	err := m.database.C(robotC).Update(
+		bson.M{"name": name},
+		bson.M{"$set": bson.M{"profile": profile}})
+	return mongoError(err)
+}
+
+func (m *mongoStore) Sessions() sessions.Store {
+	return m.sessions
+}
+
+func (m *mongoStore) SessionData(id string) (string, error) {
+	if !bson.IsObjectIdHex(id) {
+		return "", errors.New("Invalid session ID")
+	}
+	var s mongostore.Session
+	err := m.database.C(sessionC).FindId(bson.ObjectIdHex(id)).One(&s)
+	return s.Data, mongoError(err)
+}
+
+func (m *mongoStore) PutSessionData(id string, data string) error {
+	if !bson.IsObjectIdHex(id) {
+		return errors.New("Invalid session ID")
+	}
+	_, err := m.database.C(sessionC).UpsertId(bson.ObjectIdHex(id), mongostore.Session{
+		Id:       bson.ObjectIdHex(id),
+		Data:     data,
+		Modified: time.Now(),
+	})
+	return err
+}
+
+func (m *mongoStore) DelSessionData(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return errors.New("Invalid session ID")
+	}
+	err := m.database.C(sessionC).RemoveId(bson.ObjectIdHex(id))
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,228 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// touchInterval is the resolution of the last use of the API tokens.
+const touchInterval = time.Minute
+
+// APIToken is a token of a script or a kiosk, sent as "Authorization: Bearer
+// <id>.<secret>". Only the hash of the secret is stored. A token has a role and
+// can be restricted to some robots.
+type APIToken struct {
+	Id       string     `json:"id" bson:"id"`
+	Name     string     `json:"name" bson:"name"`
+	Hash     string     `json:"hash,omitempty" bson:"hash"`
+	Role     string     `json:"role" bson:"role"`
+	Robots   []string   `json:"robots,omitempty" bson:"robots,omitempty"`
+	Created  time.Time  `json:"created" bson:"created"`
+	Expires  *time.Time `json:"expires,omitempty" bson:"expires,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty" bson:"lastUsed,omitempty"`
+}
+
+// NewAPIToken is the reply of the "POST /tokens" method. Token is the only copy
+// of the secret.
+type NewAPIToken struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+var errInvalidToken = errors.New("Invalid API token")
+
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b), err
+}
+
+// bearerValues returns the session values of an API token.
+func bearerValues(bearer string) (map[interface{}]interface{}, error) {
+	i := strings.Index(bearer, ".")
+	if i < 0 {
+		return nil, errInvalidToken
+	}
+	t, err := store.APIToken(bearer[:i])
+	if err == ErrNotFound {
+		return nil, errInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(bearer[i+1:])), []byte(t.Hash)) != 1 {
+		return nil, errInvalidToken
+	}
+	now := time.Now()
+	if t.Expires != nil && now.After(*t.Expires) {
+		return nil, fmt.Errorf("API token %v expired", t.Id)
+	}
+	if t.LastUsed == nil || now.Sub(*t.LastUsed) > touchInterval {
+		err = store.TouchAPIToken(t.Id, now)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	values := map[interface{}]interface{}{"role": t.Role, "token": t.Id}
+	if len(t.Robots) > 0 {
+		values["robots"] = t.Robots
+	}
+	return values, nil
+}
+
+// inScope returns true if the request is allowed by the robots of the session
+// (API tokens restricted to some robots): the robot of the path, or the robot
+// associated with the card of the path, must be one of them. A restricted token
+// is refused when the request has no robot.
+func inScope(session map[interface{}]interface{}, r *http.Request) bool {
+	robots, ok := session["robots"].([]string)
+	if !ok {
+		return true
+	}
+	vars := mux.Vars(r)
+	name, ok := vars["robotName"]
+	if !ok {
+		cardId, ok := vars["cardId"]
+		if !ok {
+			return false
+		}
+		robot, err := store.RobotForCard(cardId)
+		if err != nil {
+			if err != ErrNotFound {
+				log.Error(err)
+			}
+			return false
+		}
+		name = robot.Name
+	}
+	return contains(robots, name)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAPITokens is the handler for the "GET /tokens" method
+func GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	_, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	tokens, err := store.APITokens()
+	if report(w, err) != nil {
+		return
+	}
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// PostAPIToken is the handler for the "POST /tokens" method. The body gives the
+// name, the role, the robots (all if empty) and the validity of the token:
+// {"name": "kiosk", "role": "helper", "robots": ["r1"], "ttl": "72h"}.
+func PostAPIToken(w http.ResponseWriter, r *http.Request) {
+	_, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	var payload struct {
+		Name   string   `json:"name"`
+		Role   string   `json:"role"`
+		Robots []string `json:"robots"`
+		TTL    string   `json:"ttl"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&payload)
+	if report(w, err) != nil {
+		return
+	}
+	if _, ok := roleLevels[payload.Role]; !ok {
+		report(w, fmt.Errorf("Unknown role: %v", payload.Role))
+		return
+	}
+	now := time.Now()
+	var t NewAPIToken
+	t.Name = payload.Name
+	t.Role = payload.Role
+	t.Robots = payload.Robots
+	t.Created = now
+	if payload.TTL != "" {
+		ttl, err := time.ParseDuration(payload.TTL)
+		if err != nil || ttl <= 0 {
+			report(w, fmt.Errorf("Invalid ttl: %v", payload.TTL))
+			return
+		}
+		expires := now.Add(ttl)
+		t.Expires = &expires
+	}
+	id, err := randomString(9)
+	if report(w, err) != nil {
+		return
+	}
+	secret, err := randomString(24)
+	if report(w, err) != nil {
+		return
+	}
+	t.Id = id
+	t.Hash = hashSecret(secret)
+	err = store.PutAPIToken(t.APIToken)
+	if report(w, err) != nil {
+		return
+	}
+	log.Infof("API token %v created: %v (%v)", t.Id, t.Name, t.Role)
+
+	t.Hash = ""
+	t.Token = id + "." + secret
+	json.NewEncoder(w).Encode(t)
+}
+
+// DelAPIToken is the handler for the "DELETE /token/{tokenId}" method
+func DelAPIToken(w http.ResponseWriter, r *http.Request) {
+	vars, _, err := initSession(w, r)
+	if report(w, err) != nil {
+		return
+	}
+
+	err = store.DelAPIToken(vars["tokenId"])
+	if report(w, err) != nil {
+		return
+	}
+	log.Infof("API token %v deleted", vars["tokenId"])
+	json.NewEncoder(w).Encode(JsonOK{"done"})
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package boltstore keeps the data of the Thymio Captain in a single BoltDB
+// file. It is used when the API runs on a laptop without MongoDB.
+//
+// BoltDB holds an exclusive lock on the file while it is open, and the file is
+// open as long as the process runs: only one process uses the file. The
+// frontend keeps its sessions through the API.
+package boltstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"time"
+)
+
+// ErrNotFound is returned when the requested key does not exist.
+var ErrNotFound = errors.New("not found")
+
+// lockTimeout is the time to wait for the lock of the file (held by another
+// process).
+const lockTimeout = 5 * time.Second
+
+// DB is an open BoltDB file.
+type DB struct {
+	db *bolt.DB
+}
+
+// Open opens the file (it is created if needed). It fails if another process
+// holds the file.
+func Open(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &DB{db: db}, nil
+}
+
+// Close closes the file.
+func (db *DB) Close() error {
+	return db.db.Close()
+}
+
+// View executes fn in a read-only transaction.
+func (db *DB) View(fn func(tx *bolt.Tx) error) error {
+	return db.db.View(fn)
+}
+
+// Update executes fn in a read-write transaction.
+func (db *DB) Update(fn func(tx *bolt.Tx) error) error {
+	return db.db.Update(fn)
+}
+
+// Get decodes the JSON value stored under key in bucket into v. It returns
+// ErrNotFound if the bucket or the key does not exist.
+func Get(tx *bolt.Tx, bucket string, key string, v interface{}) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return ErrNotFound
+	}
+	data := b.Get([]byte(key))
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Put stores v as JSON under key in bucket. The bucket is created if needed.
+func Put(tx *bolt.Tx, bucket string, key string, v interface{}) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// Delete removes key from bucket. Removing a missing key is not an error.
+func Delete(tx *bolt.Tx, bucket string, key string) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+// ForEach calls fn with the raw JSON value of every key in bucket.
+func ForEach(tx *bolt.Tx, bucket string, fn func(key string, data []byte) error) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
+
+// ForEachPrefix calls fn, in key order, with the raw JSON value of every key of
+// bucket starting with prefix.
+func ForEachPrefix(tx *bolt.Tx, bucket string, prefix string, fn func(key string, data []byte) error) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	p := []byte(prefix)
+	c := b.Cursor()
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		if err := fn(string(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
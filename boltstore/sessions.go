@@ -0,0 +1,66 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package boltstore
+
+import (
+	"github.com/BlueMasters/thymio-captain/sessionstore"
+	"github.com/boltdb/bolt"
+	"time"
+)
+
+const sessionB = "sessions"
+
+// Session is the record stored for each session. It has the same shape as the
+// documents of the mongostore.
+type Session struct {
+	Data     string    `json:"data"`
+	Modified time.Time `json:"modified"`
+}
+
+// Sessions is the sessionstore.Backend keeping the sessions in the file.
+type Sessions struct {
+	db *DB
+}
+
+// NewSessions returns the backend of the sessions of db.
+func NewSessions(db *DB) *Sessions {
+	return &Sessions{db: db}
+}
+
+// Load returns the encoded values of the session with the given ID.
+func (s *Sessions) Load(id string) (string, error) {
+	var session Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return Get(tx, sessionB, id, &session)
+	})
+	if err == ErrNotFound {
+		err = sessionstore.ErrNotFound
+	}
+	return session.Data, err
+}
+
+// Save stores the encoded values of a session.
+func (s *Sessions) Save(id string, data string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return Put(tx, sessionB, id, Session{Data: data, Modified: time.Now()})
+	})
+}
+
+// Delete removes a session.
+func (s *Sessions) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return Delete(tx, sessionB, id)
+	})
+}
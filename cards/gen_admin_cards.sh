@@ -1,12 +1,20 @@
 #!/usr/bin/env bash
 
+# usage: gen_admin_cards.sh [pages] [organizer|operator|helper]
+
 URL="https://thymio.tk/cardlogin"
 SOURCE="staff.png"
+ROLE=${2:-organizer}
 DEST="admin_pages_all.pdf"
 
 source lib.sh
 source secret.sh
-SECRET=$ADMIN_SECRET
+case $ROLE in
+    organizer) SECRET=$ADMIN_SECRET ;;
+    operator)  SECRET=$OPERATOR_SECRET; DEST="operator_pages_all.pdf" ;;
+    helper)    SECRET=$HELPER_SECRET; DEST="helper_pages_all.pdf" ;;
+    *) echo "Unknown role: $ROLE"; exit 1 ;;
+esac
 
 pages=${1:-3}
-doc $pages
\ No newline at end of file
+doc $pages
@@ -7,6 +7,7 @@ DEST="user_pages_all.pdf"
 source lib.sh
 source secret.sh
 SECRET=$USER_SECRET
+ROLE=kid
 
 pages=${1:-3}
 doc $pages
\ No newline at end of file
@@ -1,9 +1,20 @@
 #!/usr/bin/env bash
 
+# card_id prints the ID of a new card. With KEY_ID and KEYRING in secret.sh,
+# it is a versioned token of the role $ROLE, valid for $TTL (no expiry if
+# empty). Otherwise it is a legacy token signed with $SECRET.
+card_id() {
+    if [ -n "$KEY_ID" ]; then
+        ../genid/genid -key-id "$KEY_ID" -keyring "${KEYRING:?KEYRING must be set with KEY_ID}" -role "$ROLE" -ttl "${TTL:-0}"
+    else
+        ../genid/genid -short -key "$SECRET"
+    fi
+}
+
 page() {
     pageno=$1
     for i in $(seq 8); do
-        x=$(../genid/genid -short -key "$SECRET")
+        x=$(card_id)
         echo "$URL/$x" | qrencode -s 10 -o $temp/q.png
         composite -geometry +720+320  $temp/q.png $SOURCE $temp/res$i.png
         convert -font SourceCodePro -pointsize 22 -fill black -draw "text 50,810 \"$URL/$x\"" $temp/res$i.png $temp/resb$i.png
@@ -1,10 +1,19 @@
 #!/usr/bin/env bash
 
+# usage: print_admin_url.sh [count] [organizer|operator|helper]
+
 URL="https://thymio.tk/cardlogin"
+ROLE=${2:-organizer}
+source lib.sh
 source secret.sh
-SECRET=$ADMIN_SECRET
+case $ROLE in
+    organizer) SECRET=$ADMIN_SECRET ;;
+    operator)  SECRET=$OPERATOR_SECRET ;;
+    helper)    SECRET=$HELPER_SECRET ;;
+    *) echo "Unknown role: $ROLE"; exit 1 ;;
+esac
 
 for i in $(seq ${1:-10}); do
-    x=$(../genid/genid -short -key "$SECRET")
+    x=$(card_id)
     echo "$URL/$x"
-done
\ No newline at end of file
+done
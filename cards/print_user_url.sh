@@ -1,10 +1,12 @@
 #!/usr/bin/env bash
 
 URL="https://thymio.tk/start"
+source lib.sh
 source secret.sh
 SECRET=$USER_SECRET
+ROLE=kid
 
 for i in $(seq ${1:-10}); do
-    x=$(../genid/genid -short -key "$SECRET")
+    x=$(card_id)
     echo "$URL/$x"
 done
\ No newline at end of file
@@ -0,0 +1,194 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cardtoken implements the tokens printed on the cards (the IDs of the
+// "/start" and "/cardlogin" URLs). A token is encoded in base64 (URL variant,
+// without padding) and holds, in this order:
+//
+//	version   1 byte (1)
+//	key ID    1 byte (length) + the ID of the signing key
+//	nonce     12 random bytes
+//	issued    4 bytes (unix time, big endian)
+//	expires   4 bytes (unix time, big endian, 0 for no expiry)
+//	role      1 byte (0 kid, 1 helper, 2 operator, 3 organizer)
+//	signature the first 16 bytes of the HMAC-SHA256 of the previous fields
+//
+// The key ID selects the key of the keyring, so that new keys can be added
+// without invalidating the cards already printed.
+package cardtoken
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Version is the version of the tokens.
+	Version = 1
+
+	nonceLen = 12
+	sigLen   = 16
+	maxKeyID = 32
+)
+
+// Roles, in the order of their code.
+var Roles = []string{"kid", "helper", "operator", "organizer"}
+
+// Errors returned by Verify.
+var (
+	ErrMalformed  = errors.New("malformed token")
+	ErrVersion    = errors.New("unknown token version")
+	ErrUnknownKey = errors.New("unknown key")
+	ErrSignature  = errors.New("invalid signature")
+	ErrExpired    = errors.New("token expired")
+)
+
+// Token is the content of a token.
+type Token struct {
+	KeyID   string
+	Issued  time.Time
+	Expires time.Time // zero if the token does not expire
+	Role    string
+}
+
+// Keyring holds the active keys, by ID.
+type Keyring map[string][]byte
+
+// LoadKeyring reads a keyring file. Each line holds a key ID and its secret,
+// separated by spaces. Empty lines and lines starting with "#" are ignored.
+func LoadKeyring(path string) (Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := make(Keyring)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > maxKeyID {
+			return nil, fmt.Errorf("%v:%d: invalid key", path, n)
+		}
+		k[fields[0]] = []byte(fields[1])
+	}
+	return k, scanner.Err()
+}
+
+func roleCode(role string) (byte, error) {
+	for i, r := range Roles {
+		if r == role {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role: %v", role)
+}
+
+func sign(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:sigLen]
+}
+
+// New returns a new token signed with the key keyID. The token does not expire
+// if expires is zero.
+func New(keyID string, key []byte, role string, expires time.Time) (string, error) {
+	if keyID == "" || len(keyID) > maxKeyID {
+		return "", fmt.Errorf("invalid key ID: %q", keyID)
+	}
+	code, err := roleCode(role)
+	if err != nil {
+		return "", err
+	}
+	data := []byte{Version, byte(len(keyID))}
+	data = append(data, keyID...)
+	nonce := make([]byte, nonceLen)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	data = append(data, nonce...)
+	var dates [8]byte
+	binary.BigEndian.PutUint32(dates[0:4], uint32(time.Now().Unix()))
+	if !expires.IsZero() {
+		binary.BigEndian.PutUint32(dates[4:8], uint32(expires.Unix()))
+	}
+	data = append(data, dates[:]...)
+	data = append(data, code)
+	data = append(data, sign(key, data)...)
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// IsToken returns true if s looks like a token of this package (and not like a
+// legacy token). It does not check the signature.
+func IsToken(s string) bool {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	return err == nil && len(data) > 2 && data[0] == Version && len(data) == tokenLen(int(data[1]))
+}
+
+func tokenLen(keyIDLen int) int {
+	return 2 + keyIDLen + nonceLen + 8 + 1 + sigLen
+}
+
+// Verify checks a token and returns its content.
+func (k Keyring) Verify(s string, now time.Time) (Token, error) {
+	var t Token
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) < 2 {
+		return t, ErrMalformed
+	}
+	if data[0] != Version {
+		return t, ErrVersion
+	}
+	n := int(data[1])
+	if len(data) != tokenLen(n) {
+		return t, ErrMalformed
+	}
+	t.KeyID = string(data[2 : 2+n])
+	key, ok := k[t.KeyID]
+	if !ok {
+		return t, ErrUnknownKey
+	}
+	signed := data[:len(data)-sigLen]
+	if !hmac.Equal(sign(key, signed), data[len(data)-sigLen:]) {
+		return t, ErrSignature
+	}
+	p := 2 + n + nonceLen
+	t.Issued = time.Unix(int64(binary.BigEndian.Uint32(data[p:p+4])), 0)
+	if e := binary.BigEndian.Uint32(data[p+4 : p+8]); e != 0 {
+		t.Expires = time.Unix(int64(e), 0)
+	}
+	code := int(data[p+8])
+	if code >= len(Roles) {
+		return t, ErrMalformed
+	}
+	t.Role = Roles[code]
+	if !t.Expires.IsZero() && now.After(t.Expires) {
+		return t, ErrExpired
+	}
+	return t, nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cardtoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var keyring = Keyring{
+	"2016": []byte("first-secret"),
+	"2017": []byte("second-secret"),
+}
+
+func newToken(t *testing.T, keyID string, role string, expires time.Time) string {
+	s, err := New(keyID, keyring[keyID], role, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// legacyToken returns a token of "genid -short": 20 random bytes and their
+// HMAC-SHA1.
+func legacyToken(key string) string {
+	data := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write(data)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(data))
+}
+
+func TestRoundTrip(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(48 * time.Hour).Truncate(time.Second)
+	for _, keyID := range []string{"2016", "2017"} {
+		for _, role := range Roles {
+			s := newToken(t, keyID, role, expires)
+			if !IsToken(s) {
+				t.Errorf("%v: not a token", s)
+			}
+			tok, err := keyring.Verify(s, now)
+			if err != nil {
+				t.Fatalf("%v %v: %v", keyID, role, err)
+			}
+			if tok.KeyID != keyID || tok.Role != role || !tok.Expires.Equal(expires) {
+				t.Errorf("%v %v: got %+v", keyID, role, tok)
+			}
+			if d := now.Sub(tok.Issued); d < 0 || d > time.Minute+time.Second {
+				t.Errorf("%v %v: issued %v", keyID, role, tok.Issued)
+			}
+		}
+	}
+}
+
+func TestNoExpiry(t *testing.T) {
+	s := newToken(t, "2016", "kid", time.Time{})
+	tok, err := keyring.Verify(s, time.Now().AddDate(10, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tok.Expires.IsZero() {
+		t.Errorf("expires %v", tok.Expires)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	s := newToken(t, "2016", "helper", expires)
+	if _, err := keyring.Verify(s, expires.Add(-time.Minute)); err != nil {
+		t.Errorf("before expiry: %v", err)
+	}
+	if _, err := keyring.Verify(s, expires.Add(time.Minute)); err != ErrExpired {
+		t.Errorf("after expiry: %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	s := newToken(t, "2017", "organizer", time.Time{})
+	if _, err := (Keyring{"2016": keyring["2016"]}).Verify(s, time.Now()); err != ErrUnknownKey {
+		t.Errorf("got %v, want %v", err, ErrUnknownKey)
+	}
+	// a key with the right ID but another secret
+	if _, err := (Keyring{"2017": []byte("other")}).Verify(s, time.Now()); err != ErrSignature {
+		t.Errorf("got %v, want %v", err, ErrSignature)
+	}
+}
+
+func TestTampered(t *testing.T) {
+	s := newToken(t, "2016", "kid", time.Time{})
+	data, _ := base64.RawURLEncoding.DecodeString(s)
+	for i := 2 + len("2016"); i < len(data); i++ {
+		tampered := append([]byte{}, data...)
+		tampered[i] ^= 1
+		_, err := keyring.Verify(base64.RawURLEncoding.EncodeToString(tampered), time.Now())
+		if err != ErrSignature {
+			t.Errorf("byte %d changed: %v, want %v", i, err, ErrSignature)
+		}
+	}
+	// the role of a kid card changed to organizer
+	data[len(data)-sigLen-1] = 3
+	if _, err := keyring.Verify(base64.RawURLEncoding.EncodeToString(data), time.Now()); err != ErrSignature {
+		t.Errorf("role changed: %v, want %v", err, ErrSignature)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	s := newToken(t, "2016", "kid", time.Time{})
+	data, _ := base64.RawURLEncoding.DecodeString(s)
+	for n := 0; n < len(data); n++ {
+		truncated := base64.RawURLEncoding.EncodeToString(data[:n])
+		if IsToken(truncated) {
+			t.Errorf("%d bytes: is a token", n)
+		}
+		if _, err := keyring.Verify(truncated, time.Now()); err != ErrMalformed {
+			t.Errorf("%d bytes: %v, want %v", n, err, ErrMalformed)
+		}
+	}
+	if _, err := keyring.Verify("not base64!", time.Now()); err != ErrMalformed {
+		t.Errorf("invalid base64: %v, want %v", err, ErrMalformed)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	s := newToken(t, "2016", "kid", time.Time{})
+	data, _ := base64.RawURLEncoding.DecodeString(s)
+	data[0] = Version + 1
+	if _, err := keyring.Verify(base64.RawURLEncoding.EncodeToString(data), time.Now()); err != ErrVersion {
+		t.Errorf("got %v, want %v", err, ErrVersion)
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	s := legacyToken("change-me")
+	if IsToken(s) {
+		t.Errorf("legacy token %v is a token", s)
+	}
+	if _, err := keyring.Verify(s, time.Now()); err == nil {
+		t.Errorf("legacy token %v verified", s)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	if _, err := New("", []byte("k"), "kid", time.Time{}); err == nil {
+		t.Error("empty key ID accepted")
+	}
+	if _, err := New("2016", []byte("k"), "captain", time.Time{}); err == nil {
+		t.Error("unknown role accepted")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	f, err := ioutil.TempFile("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# keys of the events\n\n2016 first-secret\n  2017   second-secret  \n")
+	f.Close()
+
+	k, err := LoadKeyring(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k) != 2 || string(k["2016"]) != "first-secret" || string(k["2017"]) != "second-secret" {
+		t.Errorf("got %q", k)
+	}
+
+	f, _ = os.Create(f.Name())
+	f.WriteString("2016\n")
+	f.Close()
+	if _, err := LoadKeyring(f.Name()); err == nil {
+		t.Error("key without secret accepted")
+	}
+}
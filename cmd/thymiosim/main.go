@@ -0,0 +1,285 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//   _   _                     _                             _        _
+//  | |_| |__  _   _ _ __ ___ (_) ___         ___ __ _ _ __ | |_ __ _(_)_ __
+//  | __| '_ \| | | | '_ ` _ \| |/ _ \ _____ / __/ _` | '_ \| __/ _` | | '_ \
+//  | |_| | | | |_| | | | | | | | (_) |_____| (_| (_| | |_) | || (_| | | | | |
+//   \__|_| |_|\__, |_| |_| |_|_|\___/       \___\__,_| .__/ \__\__,_|_|_| |_|
+//             |___/                                  |_|
+//
+
+// Robot simulator. It serves the same HTTP API as the firmware running on the
+// Raspberry Pi of the robots (thymio/flask_dev/server.py) and can be
+// registered in the API like a real robot, with the URL
+// http://<host>:<port>/api/v1
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BlueMasters/thymio-captain/program"
+	"github.com/BlueMasters/thymio-captain/sim"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const prefix = "/api/v1"
+
+type JsonResult struct {
+	Result string `json:"result"`
+}
+
+type State struct {
+	Running bool             `json:"running"`
+	Step    int              `json:"step"`
+	Elapsed float64          `json:"elapsed"`
+	Outcome string           `json:"outcome,omitempty"`
+	Steps   []sim.StepResult `json:"steps"`
+	sim.Calibration
+	Pose        sim.Pose `json:"pose"`
+	TopColor    string   `json:"topColor"`
+	BottomColor string   `json:"bottomColor"`
+}
+
+var (
+	mu      sync.Mutex
+	robot   *sim.Robot
+	prog    = program.Program{}
+	current *sim.Run
+	course  *sim.Course // nil without course
+	start   sim.Pose
+	speed   *float64
+
+	// calibrated is the end of the calibration in progress
+	calibrated time.Time
+)
+
+func result(w http.ResponseWriter, res string) {
+	json.NewEncoder(w).Encode(JsonResult{res})
+}
+
+// running returns true if a program or a calibration is being executed. The
+// caller must hold mu.
+func running() bool {
+	return (current != nil && current.Outcome == sim.Running) || time.Now().Before(calibrated)
+}
+
+// play executes the run, in real time if speed is 1. Like the simulations of
+// the API, the run stops when the robot hits a wall or leaves the board.
+func play(run *sim.Run) {
+	for {
+		mu.Lock()
+		more := run.Tick()
+		if more && sim.CheckCourse(course, run) {
+			more = false
+		}
+		mu.Unlock()
+		if !more {
+			log.Infof("Program %v after %v", run.Outcome, run.Elapsed())
+			return
+		}
+		if *speed > 0 {
+			time.Sleep(time.Duration(float64(sim.Tick) / *speed))
+		}
+	}
+}
+
+// Upload is the handler for the "PUT /upload" method
+func Upload(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Program program.Program `json:"program"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		log.Info(err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	mu.Lock()
+	prog = payload.Program
+	mu.Unlock()
+	log.Infof("Program uploaded: %d steps", len(payload.Program))
+	result(w, "ok")
+}
+
+// Run is the handler for the "GET /run" method. The robot is put back at the
+// start of the course before each run.
+func Run(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	if running() {
+		result(w, "already running")
+		return
+	}
+	robot.Pose = start
+	current = sim.NewRun(robot, prog)
+	go play(current)
+	log.Info("Program started")
+	result(w, "ok")
+}
+
+// Stop is the handler for the "GET /stop" method
+func Stop(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	if current != nil {
+		current.Stop()
+	}
+	result(w, "ok")
+}
+
+// Ping is the handler for the "GET /ping" method
+func Ping(w http.ResponseWriter, r *http.Request) {
+	result(w, "ok")
+}
+
+// Prog is the handler for the "GET /prog" method
+func Prog(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	json.NewEncoder(w).Encode([]program.Step(prog))
+}
+
+// calibrate returns the handler of a calibration. The simulated robot moves
+// exactly as its calibration says, so the calibration takes the time of the
+// measurement (20cm, 90 degrees or one second for the wall) and finds the same
+// constants.
+func calibrate(name string, duration func(c sim.Calibration) float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if running() {
+			result(w, "already running")
+			return
+		}
+		if *speed > 0 {
+			d := duration(robot.Calibration) / *speed
+			calibrated = time.Now().Add(time.Duration(d * float64(time.Second)))
+		}
+		log.Infof("%v calibration started", name)
+		result(w, "ok")
+	}
+}
+
+// SetCalibration is the handler for the "PUT /calibration" method. The missing
+// constants are not changed.
+func SetCalibration(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	if running() {
+		result(w, "already running")
+		return
+	}
+	c := robot.Calibration
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err == nil && (c.CmTime <= 0 || c.AngleTime <= 0 || c.Wall <= 0 || c.Floor <= 0) {
+		err = errors.New("invalid calibration")
+	}
+	if err != nil {
+		log.Info(err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	robot.Calibration = c
+	log.Infof("Calibration set: %+v", c)
+	result(w, "ok")
+}
+
+// GetState is the handler for the "GET /state" method
+func GetState(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	defer mu.Unlock()
+	state := State{
+		Running:     running(),
+		Steps:       []sim.StepResult{},
+		Calibration: robot.Calibration,
+		Pose:        robot.Pose,
+		TopColor:    robot.TopColor,
+		BottomColor: robot.BottomColor,
+	}
+	if current != nil {
+		state.Step = current.Step
+		if n := len(current.Steps); current.Outcome != sim.Running && n > 0 {
+			state.Step = current.Steps[n-1].Index
+		}
+		state.Elapsed = current.Elapsed().Seconds()
+		state.Outcome = current.Outcome
+		state.Steps = current.Steps
+	}
+	json.NewEncoder(w).Encode(state)
+}
+
+func main() {
+	var port = flag.Int("port", 5000, "port")
+	var debug = flag.Bool("debug", false, "run in debug mode")
+	speed = flag.Float64("speed", 1, "Simulation speed (1 is real time, 0 is as fast as possible)")
+	var courseFile = flag.String("course", "", "Course (SVG drawing of the board or JSON file)")
+	var dumpCourse = flag.Bool("dump-course", false, "Print the course as JSON and exit")
+
+	flag.Parse()
+
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+		log.Debug("Debug mode")
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	var env sim.Environment = sim.Empty{}
+	if *courseFile != "" {
+		var err error
+		course, err = sim.LoadCourse(*courseFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *dumpCourse {
+			out, _ := json.MarshalIndent(course, "", "  ")
+			fmt.Println(string(out))
+			return
+		}
+		log.Infof("Course %v: %d lines, %d areas, %d walls", course.Name,
+			len(course.Lines), len(course.Areas), len(course.Walls))
+		env = course
+		start = course.Start
+	}
+	robot = sim.NewRobot(env, start)
+
+	r := mux.NewRouter()
+	r.HandleFunc(prefix+"/upload", Upload).Methods("PUT")
+	r.HandleFunc(prefix+"/run", Run).Methods("GET")
+	r.HandleFunc(prefix+"/stop", Stop).Methods("GET")
+	r.HandleFunc(prefix+"/ping", Ping).Methods("GET")
+	r.HandleFunc(prefix+"/prog", Prog).Methods("GET")
+	r.HandleFunc(prefix+"/state", GetState).Methods("GET")
+	r.HandleFunc(prefix+"/calibration", SetCalibration).Methods("PUT")
+	r.HandleFunc(prefix+"/calibline", calibrate("Line", func(c sim.Calibration) float64 {
+		return 20 * c.CmTime
+	})).Methods("GET")
+	r.HandleFunc(prefix+"/calibrot", calibrate("Rotation", func(c sim.Calibration) float64 {
+		return 90 * c.AngleTime
+	})).Methods("GET")
+	r.HandleFunc(prefix+"/calibwall", calibrate("Wall", func(c sim.Calibration) float64 {
+		return 1
+	})).Methods("GET")
+
+	http.Handle("/", r)
+	log.Infof("Ready, listening on port %d (robot URL: http://localhost:%d%s)", *port, *port, prefix)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+}
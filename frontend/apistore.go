@@ -0,0 +1,110 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BlueMasters/thymio-captain/sessionstore"
+	"github.com/gorilla/securecookie"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const apiTimeout = 5 * time.Second
+
+// apiBackend is the sessionstore.Backend of a frontend keeping its sessions
+// through the API (when the API keeps its data in a BoltDB file). It proves the
+// secret key to the API by sending the session ID encoded like the cookie.
+type apiBackend struct {
+	url    string
+	codecs []securecookie.Codec
+	client *http.Client
+}
+
+func newAPIBackend(url string, secretKey []byte) *apiBackend {
+	return &apiBackend{
+		url:    url,
+		codecs: securecookie.CodecsFromPairs(secretKey),
+		client: &http.Client{Timeout: apiTimeout},
+	}
+}
+
+// do sends a request for the session id and decodes the reply into v (if not
+// nil). It returns sessionstore.ErrNotFound if the API replies 404.
+func (a *apiBackend) do(method string, path string, id string, body interface{}, v interface{}) error {
+	var data bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&data).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, a.url+path, &data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id != "" {
+		cookie, err := securecookie.EncodeMulti(sessionKey, id, a.codecs...)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Cookie "+cookie)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return sessionstore.ErrNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API: %v %v: %v", method, path, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Load returns the encoded values of the session with the given ID.
+func (a *apiBackend) Load(id string) (string, error) {
+	var session struct {
+		Data string `json:"data"`
+	}
+	err := a.do("GET", "/session", id, nil, &session)
+	return session.Data, err
+}
+
+// Save stores the encoded values of a session.
+func (a *apiBackend) Save(id string, data string) error {
+	return a.do("PUT", "/session", id, map[string]string{"data": data}, nil)
+}
+
+// Delete removes a session.
+func (a *apiBackend) Delete(id string) error {
+	return a.do("DELETE", "/session", id, nil, nil)
+}
+
+// isRevoked asks the API if a card is revoked.
+func (a *apiBackend) isRevoked(token string) (bool, error) {
+	var reply struct {
+		Revoked bool `json:"revoked"`
+	}
+	err := a.do("GET", "/revoked/"+url.PathEscape(token), "", nil, &reply)
+	return reply.Revoked, err
+}
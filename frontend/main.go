@@ -27,23 +27,29 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/BlueMasters/thymio-captain/cardtoken"
+	"github.com/BlueMasters/thymio-captain/sessionstore"
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/kidstuff/mongostore"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 	"html/template"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 const (
 	dbName       = "thymio_captain"
 	sessionC     = "sessions"
+	revokedC     = "revoked" // revocation list, managed by the API
 	maxAge       = 24 * 3600
 	sessionKey   = "session-key"
 	root         = "internal_pages"
@@ -53,14 +59,29 @@ const (
 
 var (
 	database       *mgo.Session
-	store          *mongostore.MongoStore
+	api            *apiBackend // sessions and revocation list kept by the API
+	store          sessions.Store
 	adminSecretKey *string
 	startSecretKey *string
 	templates      = make(map[string]*template.Template)
+
+	// roleSecretKeys are the keys of the legacy staff cards, from the most to the
+	// least privileged role. The admin key is the key of the organizers.
+	roleSecretKeys []roleKey
+	// keyring holds the keys of the versioned tokens (nil if there is none).
+	keyring      cardtoken.Keyring
+	legacyTokens *bool
 )
 
+type roleKey struct {
+	role string
+	key  *string
+}
+
 func initSession(w http.ResponseWriter, r *http.Request) (vars map[string]string, session *sessions.Session, err error) {
-	database.Refresh()
+	if database != nil {
+		database.Refresh()
+	}
 	vars = mux.Vars(r)
 	session, err = store.Get(r, sessionKey)
 	log.Debugf("Session ID = %v", session.ID)
@@ -94,19 +115,98 @@ func isValidToken(token string, key string) bool {
 	return hmac.Equal(mac.Sum(nil), sig)
 }
 
+// verifyToken checks a versioned token. It returns false if the token is not a
+// versioned token or if there is no keyring.
+func verifyToken(id string) (cardtoken.Token, bool) {
+	if keyring == nil || !cardtoken.IsToken(id) {
+		return cardtoken.Token{}, false
+	}
+	t, err := keyring.Verify(id, time.Now())
+	if err != nil {
+		log.Infof("Invalid token %v: %v", id, err)
+		return t, false
+	}
+	return t, true
+}
+
+// staffRole returns the role of a staff card, or "" if the card is not a valid
+// staff card.
+func staffRole(id string) string {
+	if t, ok := verifyToken(id); ok {
+		if t.Role == "kid" {
+			return ""
+		}
+		return t.Role
+	}
+	if *legacyTokens {
+		for _, k := range roleSecretKeys {
+			if *k.key != "" && isValidToken(id, *k.key) {
+				return k.role
+			}
+		}
+	}
+	return ""
+}
+
+// isValidStartId returns true if the ID of a start page is valid. Without key
+// (no keyring and no start key), all the IDs are valid.
+func isValidStartId(id string) bool {
+	if _, ok := verifyToken(id); ok {
+		return true
+	}
+	if keyring == nil && *startSecretKey == "" {
+		return true
+	}
+	return *legacyTokens && (*startSecretKey == "" || isValidToken(id, *startSecretKey))
+}
+
+// isRevoked returns true if the card is in the revocation list (or if the list
+// cannot be read).
+func isRevoked(id string) bool {
+	var err error
+	revoked := false
+	if database != nil {
+		var n int
+		n, err = database.DB(dbName).C(revokedC).Find(bson.M{"token": id}).Count()
+		revoked = n > 0
+	} else if api != nil {
+		revoked, err = api.isRevoked(id)
+	}
+	if err != nil {
+		log.Errorf("Revocation list: %v", err)
+		return true
+	}
+	if revoked {
+		log.Warnf("Revoked card: %v", id)
+	}
+	return revoked
+}
+
 func CardLogin(w http.ResponseWriter, r *http.Request) {
 	vars, session, err := initSession(w, r)
 	if err != nil {
 		return
 	}
-	if isValidToken(vars["CardId"], *adminSecretKey) {
-		log.Debugf("Valid Card Login: %v", vars["CardId"])
-		session.Values["admin"] = "1"
+	role := staffRole(vars["CardId"])
+	if role != "" && isRevoked(vars["CardId"]) {
+		role = ""
+	}
+	if role != "" {
+		log.Debugf("Valid Card Login (%v): %v", role, vars["CardId"])
+		// the admin flag of the older consumers is only given to the organizers
+		session.Values["admin"] = "0"
+		if role == "organizer" {
+			session.Values["admin"] = "1"
+		}
+		session.Values["role"] = role
+		session.Values["login"] = vars["CardId"]
 		sessions.Save(r, w)
 		err = templates["login-ok.html"].Execute(w, nil)
 	} else {
 		log.Infof("Bad Card Login: %v", vars["CardId"])
 		session.Values["admin"] = "0"
+		session.Values["role"] = "kid"
+		delete(session.Values, "login")
 		sessions.Save(r, w)
 		err = templates["login-failed.html"].Execute(w, nil)
 	}
@@ -123,6 +223,8 @@ func Logout(w http.ResponseWriter, r *http.Request) {
 
 	log.Debug("Logout")
 	session.Values["admin"] = "0"
+	session.Values["role"] = "kid"
+	delete(session.Values, "login")
 	sessions.Save(r, w)
 
 	err = templates["logout.html"].Execute(w, nil)
@@ -183,14 +285,22 @@ func Start(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if *startSecretKey == "" || isValidToken(vars["CardId"], *startSecretKey) {
+	if isValidStartId(vars["CardId"]) && !isRevoked(vars["CardId"]) {
 		log.Debugf("Valid Start page: %v", vars["CardId"])
 		session.Values["cardId"] = vars["CardId"]
+		if login, ok := session.Values["login"].(string); ok && isRevoked(login) {
+			session.Values["admin"] = "0"
+			session.Values["role"] = "kid"
+			delete(session.Values, "login")
+		}
 		sessions.Save(r, w)
 
 		var fileName string
 
-		if session.Values["admin"] == "1" {
+		// the staff sessions without card were opened before the revocation list
+		role, _ := session.Values["role"].(string)
+		login, _ := session.Values["login"].(string)
+		if role != "" && role != "kid" && login != "" {
 			log.Debug("Sending Admin UI")
 			fileName = root + "/admin.html"
 		} else {
@@ -213,13 +323,59 @@ func Start(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// openStore opens the session store described by spec. The spec has the form
+// "kind[:argument]", for example "mongo:localhost" or "api:http://localhost:8081/v1"
+// (the sessions are kept by the API, when it uses a BoltDB file).
+func openStore(spec string, secretKey []byte, domain string) (sessions.Store, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "mongo":
+		if arg == "" {
+			arg = "localhost"
+		}
+		var err error
+		database, err = mgo.Dial(arg)
+		if err != nil {
+			return nil, err
+		}
+		s := mongostore.NewMongoStore(
+			database.DB(dbName).C(sessionC),
+			maxAge, true, secretKey)
+		s.Options.Domain = domain
+		return s, nil
+	case "api":
+		if arg == "" {
+			return nil, errors.New("Missing URL for the api store")
+		}
+		api = newAPIBackend(strings.TrimSuffix(arg, "/"), secretKey)
+		s := sessionstore.New(api, maxAge, secretKey)
+		s.Options.Domain = domain
+		return s, nil
+	default:
+		return nil, fmt.Errorf("Unknown store: %v", kind)
+	}
+}
+
 func main() {
 	var port = flag.Int("port", 8080, "port")
 	var debug = flag.Bool("debug", false, "run in debug mode")
 	var domain = flag.String("domain", "thymio.tk", "Domain name (for the cookie)")
 	var mongoServer = flag.String("mongo-server", "localhost", "MongoDB server URL")
+	var storeSpec = flag.String("store", "mongo", "Session store (mongo[:server] or api:url)")
 	var cookieSecretKey = flag.String("cookie-secret-key", "not-so-secret", "Secret key (for secure cookies)")
 	adminSecretKey = flag.String("admin-secret-key", "change-me", "Secret key (for admin card-login)")
+	var operatorSecretKey = flag.String("operator-secret-key", "", "Secret key (for operator card-login)")
+	var helperSecretKey = flag.String("helper-secret-key", "", "Secret key (for helper card-login)")
+	var keyringFile = flag.String("keyring", "", "Keyring of the versioned card tokens")
+	legacyTokens = flag.Bool("legacy-tokens", true, "Accept the legacy (HMAC-SHA1) card tokens")
+	roleSecretKeys = []roleKey{
+		{"organizer", adminSecretKey},
+		{"operator", operatorSecretKey},
+		{"helper", helperSecretKey},
+	}
 	startSecretKey = flag.String("start-secret-key", "", "Secret key (for start ID)")
 
 	flag.Parse()
@@ -231,22 +387,31 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
-	if *startSecretKey == "" {
+	if *keyringFile != "" {
+		var err error
+		keyring, err = cardtoken.LoadKeyring(*keyringFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Keyring loaded from %v (%d keys)", *keyringFile, len(keyring))
+	}
+
+	if *startSecretKey == "" && (keyring == nil || *legacyTokens) {
 		log.Warn("Running without start id validation")
 	} else {
 		log.Info("Start id validation enabled")
 	}
 
+	if *storeSpec == "mongo" {
+		*storeSpec = "mongo:" + *mongoServer
+	}
+
 	var err error
-	database, err = mgo.Dial(*mongoServer)
+	store, err = openStore(*storeSpec, []byte(*cookieSecretKey), *domain)
 	if err != nil {
 		log.Fatal(err)
 	}
-	store = mongostore.NewMongoStore(
-		database.DB(dbName).C(sessionC),
-		maxAge, true, []byte(*cookieSecretKey))
-
-	store.Options.Domain = *domain
+	log.Infof("Using store: %v", *storeSpec)
 
 	tpls := template.Must(template.ParseGlob("internal_pages/templates/*"))
 	nameList, err := filepath.Glob("internal_pages/*.html")
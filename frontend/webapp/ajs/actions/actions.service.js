@@ -12,20 +12,25 @@
             this.param = param || null;
 
             this.args = function(){
-                return ACTIONS[this.type].args;
+                return definition( this.type ).args;
             };
 
             this.title = function(){
-                return ACTIONS[this.type].title;
+                return definition( this.type ).title;
             };
 
             this.color = function(){
-                return ACTIONS[this.type].color;
-            }
+                return definition( this.type ).color;
+            };
+
+            this.icon = function(){
+                return definition( this.type ).icon || this.type + ".png";
+            };
         }
 
         Action.actionsList = getAvailActions;
         Action.fromJson = fromJson;
+        Action.setCatalog = setCatalog;
         Action.prototype.toJson = asRestParam;
 
         // ----------------------------------------------------
@@ -37,12 +42,47 @@
         function getAvailActions(){
             var array = [];
             for( var key in ACTIONS ){
-                array.push( new Action( key ) );
+                if( !ACTIONS[key].disabled ) array.push( new Action( key ) );
             }
 
             return array;
         }
 
+        /**
+         * Returns the definition of an action, or a placeholder if the action
+         * is unknown (a saved program can use an action the catalog no longer
+         * lists).
+         */
+        function definition( type ){
+            return ACTIONS[type] || {title: type, color: UNKNOWN_COLOR, args: [], disabled: true};
+        }
+
+        /**
+         * Merge the catalog served by the API (GET /actions) over the default
+         * actions. The default actions missing from the catalog are kept for
+         * the saved programs, but no longer offered. The texts are localized,
+         * we use the french version.
+         */
+        function setCatalog( catalog ){
+            var actions = [];
+            for( var key in ACTIONS ){
+                actions[key] = angular.extend( {}, ACTIONS[key], {disabled: true} );
+            }
+            for( var i in catalog ){
+                var a = catalog[i];
+                actions[a.name] = {
+                    title   : a.title[LANG],
+                    color   : a.color,
+                    icon    : a.icon,
+                    disabled: a.disabled,
+                    args    : a.args.map( function( arg ){
+                        return {id: arg.id, descr: arg.descr[LANG]};
+                    } )
+                };
+            }
+            ACTIONS = actions;
+        }
+
 
         function fromJson( obj ){
             if( typeof obj === "string" ) obj = JSON.parse( obj );
@@ -62,6 +102,12 @@
 
     // ----------------------------------------------------
 
+    var LANG = "fr";
+
+    // color of the actions missing from the catalog
+    var UNKNOWN_COLOR = "#9E9E9E"; // grey
+
+    // default actions, used until the catalog is received from the API
     var ACTIONS = [];
 
     ACTIONS["MoveForward"] = {
@@ -22,7 +22,7 @@
 
     // --------------------------
 
-    function MainCtrl( $rootScope, ModalService, RestService, Action, History ){
+    function MainCtrl( $rootScope, $interval, ModalService, RestService, Action, History, baseUrl ){
 
         var self = this;
 
@@ -33,6 +33,7 @@
         self.progState = 0;  // zero if in sync with the saved program
         self.notes = "";
         self.savedNotes = ""; // last saved notes
+        self.activeStep = -1; // index of the block executed by the robot
 
         _getCardId();    //TODO
         //self.cardId = "test";
@@ -67,6 +68,11 @@
 
 
         function _init(){
+            RestService.getActions( function( catalog ){
+                Action.setCatalog( catalog );
+                self.actions = Action.actionsList();
+            }, _log );
+
             RestService.getCardData( self.cardIdParam, function( data ){
                 $rootScope.program = Action.fromJson( data.program );
                 _initNotes( data.notes );
@@ -75,6 +81,51 @@
                 console.log( "Initialisation done: ", data );
                 updateMdl();
             }, _log );
+
+            _listenRunEvents();
+        }
+
+        function _listenRunEvents(){
+            // highlight the block executed by the robot (server-sent events,
+            // or polling if the browser cannot stream them)
+            if( !window.EventSource ){
+                _pollRunEvents();
+                return;
+            }
+            var source = new EventSource( baseUrl + 'card/' + self.cardId + '/events', {withCredentials: true} );
+            angular.forEach( ['step', 'finished', 'stopped', 'error'], function( type ){
+                source.addEventListener( type, function( e ){
+                    if( !e.data ) return; // error of the connection, not of the run
+                    $rootScope.$apply( function(){
+                        _onRunEvent( JSON.parse( e.data ) );
+                    } );
+                } );
+            } );
+            source.onerror = function(){
+                // the browser reconnects by itself, unless the stream is refused
+                if( source.readyState !== EventSource.CLOSED ) return;
+                source.close();
+                _pollRunEvents();
+            };
+        }
+
+        function _pollRunEvents(){
+            var lastDate;
+            $interval( function(){
+                RestService.lastEvent( self.cardIdParam, function( event ){
+                    if( event.date === lastDate ) return;
+                    lastDate = event.date;
+                    _onRunEvent( event );
+                }, angular.noop );
+            }, 1000 );
+        }
+
+        function _onRunEvent( event ){
+            if( event.type === 'step' ){
+                self.activeStep = event.step;
+            }else if( ['finished', 'stopped', 'error'].indexOf( event.type ) >= 0 ){
+                self.activeStep = -1;
+            }
         }
 
         function _initNotes( notes ){
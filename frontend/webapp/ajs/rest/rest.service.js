@@ -40,6 +40,19 @@
             infos: {method: 'GET', url: baseUrl + 'info'},
 
 
+            /**
+             * @ngdoc
+             * @name getActions
+             * @methodOf thymioCaptain.rest.RestService
+             *
+             * @description
+             * Returns the catalog of the actions (blocks) available for the programs.
+             * @returns {httpPromise} resolves with the list {name, title, color, icon, disabled, args}, or fails
+             * with error description.
+             */
+            getActions: {method: 'GET', url: baseUrl + 'actions', isArray: true},
+
+
             /**
              * @ngdoc
              * @name getCardData
@@ -130,6 +143,18 @@
              */
             upload: {method: 'GET', url: baseUrl + 'card/:cardId/upload', params: {cardId: '@cardId'}},
 
+            /**
+             * @ngdoc
+             * @name lastEvent
+             * @methodOf thymioCaptain.rest.RestService
+             *
+             * @description
+             * Returns the last event of the runs of the card (for the browsers that cannot stream them).
+             * @returns {httpPromise} resolves with the object {type, step, outcome, date}, or fails with error
+             * description.
+             */
+            lastEvent: {method: 'GET', url: baseUrl + 'card/:cardId/event', params: {cardId: '@cardId'}},
+
 
 
             /* ===================================================================*/
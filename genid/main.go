@@ -8,7 +8,10 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"github.com/BlueMasters/thymio-captain/cardtoken"
 	"hash"
+	"os"
+	"time"
 )
 
 func secureId(key []byte, size int, digest func() hash.Hash) (res []byte, err error) {
@@ -28,8 +31,41 @@ func main() {
 	var key = flag.String("key", "change-me", "Secret key")
 	var n = flag.Int("n", 1, "Number of ID to generate")
 	var short = flag.Bool("short", false, "Use SHA1 instead of SHA256")
+	var keyID = flag.String("key-id", "", "Key ID (generates versioned tokens, see the cardtoken package)")
+	var keyringFile = flag.String("keyring", "", "Keyring file (the key of -key-id replaces -key)")
+	var role = flag.String("role", "kid", "Role of the versioned tokens (kid, helper, operator or organizer)")
+	var ttl = flag.Duration("ttl", 0, "Validity of the versioned tokens (0 for no expiry)")
 
 	flag.Parse()
+
+	if *keyID != "" {
+		secret := []byte(*key)
+		if *keyringFile != "" {
+			keyring, err := cardtoken.LoadKeyring(*keyringFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			var ok bool
+			if secret, ok = keyring[*keyID]; !ok {
+				fmt.Fprintf(os.Stderr, "Key %v not in keyring\n", *keyID)
+				os.Exit(1)
+			}
+		}
+		var expires time.Time
+		if *ttl > 0 {
+			expires = time.Now().Add(*ttl)
+		}
+		for i := 0; i < *n; i++ {
+			t, err := cardtoken.New(*keyID, secret, *role, expires)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Println(t)
+		}
+		return
+	}
 	var dataSize int
 	var algo func() hash.Hash
 
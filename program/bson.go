@@ -0,0 +1,56 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package program
+
+import (
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	bsonBinary = 0x05
+	bsonNull   = 0x0A
+)
+
+// GetBSON stores the program in MongoDB as an array of steps.
+func (p Program) GetBSON() (interface{}, error) {
+	if p == nil {
+		return []Step{}, nil
+	}
+	return []Step(p), nil
+}
+
+// SetBSON reads a program from MongoDB. Programs saved before the introduction
+// of the Program type are stored as binary JSON and are also accepted.
+func (p *Program) SetBSON(raw bson.Raw) error {
+	switch raw.Kind {
+	case bsonNull:
+		*p = Program{}
+		return nil
+	case bsonBinary:
+		var data []byte
+		err := raw.Unmarshal(&data)
+		if err != nil {
+			return err
+		}
+		steps, err := Decode(data)
+		*p = steps
+		return err
+	default:
+		var steps []Step
+		err := raw.Unmarshal(&steps)
+		*p = steps
+		return err
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package program
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Text is a localized text, indexed by language code ("fr", "en", ...).
+type Text map[string]string
+
+// Param is a value accepted by an action.
+type Param struct {
+	Id    string `json:"id"`
+	Descr Text   `json:"descr"`
+}
+
+// Action is a block that can be used in a program.
+type Action struct {
+	Name     string  `json:"name"`
+	Title    Text    `json:"title"`
+	Color    string  `json:"color"`
+	Icon     string  `json:"icon"`
+	Disabled bool    `json:"disabled"`
+	Params   []Param `json:"args"`
+}
+
+// HasParam returns true if id is a valid parameter of the action.
+func (a Action) HasParam(id string) bool {
+	for _, p := range a.Params {
+		if p.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Catalog is the list of the actions understood by the robots.
+type Catalog []Action
+
+// Action returns the action with the given name.
+func (c Catalog) Action(name string) (Action, bool) {
+	for _, a := range c {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return Action{}, false
+}
+
+// LoadCatalog reads a catalog from a JSON file. The file has the same format
+// as the response of the "GET /actions" method of the API.
+func LoadCatalog(fileName string) (Catalog, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c Catalog
+	err = json.NewDecoder(f).Decode(&c)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid catalog %v: %v", fileName, err)
+	}
+	// the robots only implement the actions of the default catalog
+	for _, a := range c {
+		known, ok := DefaultCatalog.Action(a.Name)
+		if !ok {
+			return nil, fmt.Errorf("Invalid catalog %v: unknown action %v", fileName, a.Name)
+		}
+		for _, p := range a.Params {
+			if !known.HasParam(p.Id) {
+				return nil, fmt.Errorf("Invalid catalog %v: unknown parameter %v for %v", fileName, p.Id, a.Name)
+			}
+		}
+	}
+	return c, nil
+}
+
+func param(id string, fr string, en string) Param {
+	return Param{Id: id, Descr: Text{"fr": fr, "en": en}}
+}
+
+var (
+	moveParams = []Param{
+		param("10cm", "de 10 cm", "by 10 cm"),
+		param("20cm", "de 20 cm", "by 20 cm"),
+		param("50cm", "de 50 cm", "by 50 cm"),
+		param("UntilWall", "jusqu'au mur", "until the wall"),
+		param("UntilBlackFloor", "jusqu'à ce que le sol soit noir", "until the floor is black"),
+		param("UntilWhiteFloor", "jusqu'à ce que le sol soit blanc", "until the floor is white"),
+	}
+	colorParams = []Param{
+		param("off", "éteindre", "off"),
+		param("red", "rouge", "red"),
+		param("blue", "bleu", "blue"),
+		param("green", "vert", "green"),
+		param("pink", "rose", "pink"),
+		param("orange", "orange", "orange"),
+		param("white", "blanc", "white"),
+	}
+)
+
+// DefaultCatalog is the set of actions implemented by the robot firmware.
+var DefaultCatalog = Catalog{
+	{
+		Name:   "MoveForward",
+		Title:  Text{"fr": "avancer", "en": "move forward"},
+		Color:  "#FFC000", // yellow
+		Icon:   "MoveForward.png",
+		Params: moveParams,
+	}, {
+		Name:   "MoveBackward",
+		Title:  Text{"fr": "reculer", "en": "move backward"},
+		Color:  "#70AD47", // green
+		Icon:   "MoveBackward.png",
+		Params: moveParams,
+	}, {
+		Name:  "Turn",
+		Title: Text{"fr": "tourner", "en": "turn"},
+		Color: "#E76D19", // orange
+		Icon:  "Turn.png",
+		Params: []Param{
+			param("Right45", "de 45° sur la droite", "45° to the right"),
+			param("Right90", "de 90° sur la droite", "90° to the right"),
+			param("Right135", "de 135° sur la droite", "135° to the right"),
+			param("Right180", "de 180°", "180°"),
+			param("Left45", "de 45° sur la gauche", "45° to the left"),
+			param("Left90", "de 90° sur la gauche", "90° to the left"),
+			param("Left135", "de 135° sur la gauche", "135° to the left"),
+		},
+	}, {
+		Name:  "FollowLine",
+		Title: Text{"fr": "suivre la ligne", "en": "follow the line"},
+		Color: "#41719C", // blue
+		Icon:  "FollowLine.png",
+		Params: []Param{
+			param("10cm", "sur 10 cm", "for 10 cm"),
+			param("20cm", "sur 20 cm", "for 20 cm"),
+			param("50cm", "sur 50 cm", "for 50 cm"),
+			param("UntilWall", "jusqu'au mur", "until the wall"),
+		},
+	}, {
+		Name:   "SetTopColor",
+		Title:  Text{"fr": "couleur haut", "en": "top color"},
+		Color:  "#AA00FF", // violet
+		Icon:   "SetTopColor.png",
+		Params: colorParams,
+	}, {
+		Name:   "SetBottomColor",
+		Title:  Text{"fr": "couleur bas", "en": "bottom color"},
+		Color:  "#FF4081", // pink
+		Icon:   "SetBottomColor.png",
+		Params: colorParams,
+	},
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package program describes the programs created with the web application and
+// executed by the Thymio robots. A program is a list of steps, each step being
+// an action with a parameter. On the wire, it is the base64 encoding of the
+// JSON array [{"Action": "...", "Param": "..."}, ...].
+package program
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Step is one block of a program.
+type Step struct {
+	Action string `json:"Action" bson:"action"`
+	Param  string `json:"Param" bson:"param"`
+}
+
+// Program is the list of the steps executed by a robot.
+type Program []Step
+
+// StepError reports an invalid step of a program.
+type StepError struct {
+	Index  int
+	Action string
+	Param  string
+	Reason string
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("Step %d (%s %s): %s", e.Index, e.Action, e.Param, e.Reason)
+}
+
+// Decode parses the JSON array of the steps of a program. An empty input is an
+// empty program.
+func Decode(data []byte) (p Program, err error) {
+	if len(data) == 0 {
+		return Program{}, nil
+	}
+	err = json.Unmarshal(data, (*[]Step)(&p))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid program: %v", err)
+	}
+	if p == nil {
+		p = Program{}
+	}
+	return
+}
+
+// Encode returns the JSON array of the steps of the program.
+func (p Program) Encode() ([]byte, error) {
+	if p == nil {
+		p = Program{}
+	}
+	return json.Marshal([]Step(p))
+}
+
+// MarshalJSON encodes the program in the format expected by the web
+// application and by the robots: a base64 string holding the JSON array of the
+// steps.
+func (p Program) MarshalJSON() ([]byte, error) {
+	data, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(data)
+}
+
+// UnmarshalJSON decodes a program encoded by MarshalJSON. A plain JSON array of
+// steps is also accepted.
+func (p *Program) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		steps, err := Decode(data)
+		*p = steps
+		return err
+	}
+	var encoded []byte
+	err := json.Unmarshal(data, &encoded)
+	if err != nil {
+		return fmt.Errorf("Invalid program: %v", err)
+	}
+	steps, err := Decode(encoded)
+	*p = steps
+	return err
+}
+
+// Validate checks every step against the catalog. It returns a *StepError
+// describing the first invalid step.
+func (c Catalog) Validate(p Program) error {
+	for i, s := range p {
+		action, ok := c.Action(s.Action)
+		if !ok {
+			return &StepError{i, s.Action, s.Param, "unknown action"}
+		}
+		if action.Disabled {
+			return &StepError{i, s.Action, s.Param, "action disabled"}
+		}
+		if !action.HasParam(s.Param) {
+			return &StepError{i, s.Action, s.Param, "invalid parameter"}
+		}
+	}
+	return nil
+}
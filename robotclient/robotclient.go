@@ -0,0 +1,280 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package robotclient talks to the firmware of the robots (the HTTP API of
+// thymio/flask_dev/server.py). Every call has a deadline, the idempotent calls
+// are retried when the robot cannot be reached, and the errors tell what went
+// wrong (see Kind).
+package robotclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BlueMasters/thymio-captain/program"
+	"github.com/BlueMasters/thymio-captain/sim"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultTimeout is the deadline of a single attempt.
+	DefaultTimeout = 3 * time.Second
+	// DefaultRetries is the number of additional attempts of the idempotent
+	// calls.
+	DefaultRetries = 2
+	// retryDelay is the delay before the first retry. It doubles at each retry.
+	retryDelay = 200 * time.Millisecond
+)
+
+// Kind is the kind of an error.
+type Kind int
+
+const (
+	Unreachable Kind = iota // the robot does not answer (network error)
+	Timeout                 // the robot did not answer in time
+	Busy                    // the robot is already running a program
+	Rejected                // the robot refused the request (or the program)
+)
+
+var kindNames = map[Kind]string{
+	Unreachable: "robot unreachable",
+	Timeout:     "robot timeout",
+	Busy:        "robot busy",
+	Rejected:    "robot rejected the request",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// Status returns the HTTP status code reporting this kind of error.
+func (k Kind) Status() int {
+	switch k {
+	case Timeout:
+		return http.StatusGatewayTimeout
+	case Busy:
+		return http.StatusConflict
+	case Rejected:
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadGateway
+}
+
+// Error is the error returned by the methods of the Client.
+type Error struct {
+	Kind   Kind
+	Method string // firmware method ("ping", "run", ...)
+	Err    error  // underlying error, if any
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v (%v): %v", e.Kind, e.Method, e.Err)
+	}
+	return fmt.Sprintf("%v (%v)", e.Kind, e.Method)
+}
+
+// State is the state reported by the firmware. Step is the index of the step
+// being executed (or of the last executed step), Elapsed is the time since the
+// start of the run (seconds), Outcome is the outcome of the run (see the
+// outcomes of the sim package) and Steps are the steps already executed, with
+// the reason of their end. Old firmwares only report Running and the
+// calibration.
+type State struct {
+	Running bool             `json:"running"`
+	Step    *int             `json:"step,omitempty"`
+	Elapsed *float64         `json:"elapsed,omitempty"`
+	Outcome string           `json:"outcome,omitempty"`
+	Steps   []sim.StepResult `json:"steps,omitempty"`
+	sim.Calibration
+}
+
+// result is the reply of most methods of the firmware.
+type result struct {
+	Result string `json:"result"`
+}
+
+// Client is the client of a robot.
+type Client struct {
+	URL     string        // base URL of the firmware API (http://host:5000/api/v1)
+	Timeout time.Duration // deadline of a single attempt
+	Retries int           // additional attempts of the idempotent calls
+
+	http http.Client
+}
+
+// New returns a client for the robot at the given URL, with the default
+// timeout and retries.
+func New(baseURL string) *Client {
+	return &Client{URL: baseURL, Timeout: DefaultTimeout, Retries: DefaultRetries}
+}
+
+// Ping checks that the robot answers.
+func (c *Client) Ping() error {
+	return c.call("GET", "ping", nil, true, nil)
+}
+
+// Run starts the program uploaded on the robot. It is not retried: the robot
+// may have started even if its answer was lost.
+func (c *Client) Run() error {
+	var res result
+	err := c.call("GET", "run", nil, false, &res)
+	if err == nil && res.Result == "already running" {
+		err = &Error{Kind: Busy, Method: "run"}
+	}
+	return err
+}
+
+// Stop stops the program running on the robot.
+func (c *Client) Stop() error {
+	return c.call("GET", "stop", nil, true, nil)
+}
+
+// Upload sends a program to the robot. The program replaces the previous one,
+// so the call can be retried.
+func (c *Client) Upload(p program.Program) error {
+	body, err := json.Marshal(struct {
+		Program program.Program `json:"program"`
+	}{p})
+	if err != nil {
+		return err
+	}
+	return c.call("PUT", "upload", body, true, nil)
+}
+
+// calibrations maps the calibrations to the methods of the firmware.
+var calibrations = map[string]string{
+	"line":     "calibline",
+	"rotation": "calibrot",
+	"wall":     "calibwall",
+}
+
+// Calibrate starts a calibration of the robot: "line" (time per cm),
+// "rotation" (time per degree) or "wall" (front proximity threshold). The
+// robot is running until the calibration is over, and the new constants are
+// then reported by State. As Run, it is not retried.
+func (c *Client) Calibrate(kind string) error {
+	method, ok := calibrations[kind]
+	if !ok {
+		return fmt.Errorf("Unknown calibration: %v", kind)
+	}
+	var res result
+	err := c.call("GET", method, nil, false, &res)
+	if err == nil && res.Result == "already running" {
+		err = &Error{Kind: Busy, Method: method}
+	}
+	return err
+}
+
+// SetCalibration replaces the calibration constants of the robot (see the
+// "/calibration" method in the README). It is refused while the robot is
+// running.
+func (c *Client) SetCalibration(calibration sim.Calibration) error {
+	body, err := json.Marshal(calibration)
+	if err != nil {
+		return err
+	}
+	var res result
+	err = c.call("PUT", "calibration", body, true, &res)
+	if err == nil && res.Result == "already running" {
+		err = &Error{Kind: Busy, Method: "calibration"}
+	}
+	return err
+}
+
+// State returns the state of the robot.
+func (c *Client) State() (state State, err error) {
+	err = c.call("GET", "state", nil, true, &state)
+	return
+}
+
+// call sends a request to the robot and decodes the reply into out (if not
+// nil). Idempotent calls are retried when the robot is unreachable or does not
+// answer in time.
+func (c *Client) call(httpMethod, method string, body []byte, idempotent bool, out interface{}) error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return &Error{Kind: Unreachable, Method: method, Err: err}
+	}
+	u.Path = filepath.Join(u.Path, "/"+method)
+
+	attempts := 1
+	if idempotent {
+		attempts += c.Retries
+	}
+	delay := retryDelay
+	for i := 1; ; i++ {
+		log.Debugf("Sending %v command to robot: %v", method, u)
+		err = c.do(httpMethod, u.String(), body, out)
+		if e, ok := err.(*Error); ok {
+			e.Method = method
+			if i < attempts && (e.Kind == Unreachable || e.Kind == Timeout) {
+				log.Infof("Retrying %v command to robot %v: %v", method, u, err)
+				time.Sleep(delay)
+				delay *= 2
+				continue
+			}
+		}
+		return err
+	}
+}
+
+// do sends a single request.
+func (c *Client) do(httpMethod, u string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(httpMethod, u, reader)
+	if err != nil {
+		return &Error{Kind: Unreachable, Err: err}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+
+	client := c.http
+	client.Timeout = c.Timeout
+	res, err := client.Do(req)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return &Error{Kind: Timeout, Err: err}
+		}
+		return &Error{Kind: Unreachable, Err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return &Error{Kind: Rejected, Err: fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	err = json.NewDecoder(res.Body).Decode(out)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return &Error{Kind: Timeout, Err: err}
+		}
+		return &Error{Kind: Rejected, Err: fmt.Errorf("invalid reply: %v", err)}
+	}
+	return nil
+}
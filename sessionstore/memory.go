@@ -0,0 +1,58 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessionstore
+
+import (
+	"sync"
+)
+
+// Memory is a Backend keeping the sessions in memory (for the development and
+// the tests).
+type Memory struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+// NewMemory returns an empty Memory backend.
+func NewMemory() *Memory {
+	return &Memory{data: make(map[string]string)}
+}
+
+// Load returns the encoded values of the session with the given ID.
+func (m *Memory) Load(id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.data[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return data, nil
+}
+
+// Save stores the encoded values of a session.
+func (m *Memory) Save(id string, data string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[id] = data
+	return nil
+}
+
+// Delete removes a session.
+func (m *Memory) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, id)
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sessionstore is a sessions.Store that works like the mongostore: the
+// cookie holds the session ID and the encoded values are kept by a Backend (a
+// BoltDB file, the memory, or the API for the frontend).
+package sessionstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"net/http"
+)
+
+// ErrNotFound is returned by a Backend when the session does not exist.
+var ErrNotFound = errors.New("session not found")
+
+// Backend keeps the encoded values of the sessions.
+type Backend interface {
+	// Load returns the encoded values of a session or ErrNotFound.
+	Load(id string) (string, error)
+	// Save creates or replaces the encoded values of a session.
+	Save(id string, data string) error
+	// Delete removes a session. Removing a missing session is not an error.
+	Delete(id string) error
+}
+
+// Store is a sessions.Store keeping the values of the sessions in a Backend.
+type Store struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	backend Backend
+}
+
+// New returns a session store using backend.
+func New(backend Backend, maxAge int, keyPairs ...[]byte) *Store {
+	return &Store{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: maxAge,
+		},
+		backend: backend,
+	}
+}
+
+// NewID returns a new session ID. It has the shape of the IDs of the
+// mongostore (the hex of 12 bytes), so that the sessions can also be kept in
+// MongoDB.
+func NewID() string {
+	return hex.EncodeToString(securecookie.GenerateRandomKey(12))
+}
+
+// Load returns the encoded values of the session with the given ID.
+func (s *Store) Load(id string) (string, error) {
+	return s.backend.Load(id)
+}
+
+// Get returns a cached session or a new one.
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session referenced by the cookie or a new session. Like with
+// the mongostore, a session that the backend no longer has, or whose values
+// cannot be decoded, is replaced by a new session.
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+	data, err := s.backend.Load(session.ID)
+	if err == ErrNotFound {
+		session.ID = ""
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	err = securecookie.DecodeMulti(name, data, &session.Values, s.Codecs...)
+	if err != nil {
+		session.ID = ""
+		session.Values = make(map[interface{}]interface{})
+		return session, nil
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session values and writes the cookie with the session ID.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		err := s.backend.Delete(session.ID)
+		http.SetCookie(w, &http.Cookie{Name: session.Name(), Path: session.Options.Path, MaxAge: -1})
+		return err
+	}
+	if session.ID == "" {
+		session.ID = NewID()
+	}
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	err = s.backend.Save(session.ID, data)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     session.Name(),
+		Value:    encoded,
+		Path:     session.Options.Path,
+		Domain:   session.Options.Domain,
+		MaxAge:   session.Options.MaxAge,
+		Secure:   session.Options.Secure,
+		HttpOnly: session.Options.HttpOnly,
+	})
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Point is a point of the course (cm). The origin is the bottom left corner of
+// the board and the y axis goes up.
+type Point [2]float64
+
+// Polygon is a closed shape.
+type Polygon []Point
+
+// Line is a black line drawn on the board.
+type Line struct {
+	Points []Point `json:"points"`
+	Width  float64 `json:"width"`
+}
+
+// Course is the board on which the robots move: black lines and areas on a
+// white floor, walls, the start position and the zone of the candy basket.
+type Course struct {
+	Name   string    `json:"name"`
+	Width  float64   `json:"width"`
+	Height float64   `json:"height"`
+	Lines  []Line    `json:"lines"`
+	Areas  []Polygon `json:"areas"`
+	Walls  []Polygon `json:"walls"`
+	Start  Pose      `json:"start"`
+	Basket Polygon   `json:"basket"`
+}
+
+// LoadCourse reads a course from a SVG drawing (see LoadSVG) or from a JSON
+// file holding a Course.
+func LoadCourse(fileName string) (*Course, error) {
+	if strings.ToLower(filepath.Ext(fileName)) == ".svg" {
+		return LoadSVG(fileName)
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c Course
+	err = json.NewDecoder(f).Decode(&c)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid course %v: %v", fileName, err)
+	}
+	return &c, nil
+}
+
+// IsBlack returns true if the point is on a line or in a black area.
+func (c *Course) IsBlack(x, y float64) bool {
+	p := Point{x, y}
+	for _, l := range c.Lines {
+		for i := 1; i < len(l.Points); i++ {
+			if segmentDistance(p, l.Points[i-1], l.Points[i]) <= l.Width/2 {
+				return true
+			}
+		}
+	}
+	for _, a := range c.Areas {
+		if a.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Distance returns the distance from the point to the nearest wall in the
+// direction theta, or +Inf if there is no wall.
+func (c *Course) Distance(x, y, theta float64) float64 {
+	d := math.Inf(1)
+	p := Point{x, y}
+	dir := Point{math.Cos(theta), math.Sin(theta)}
+	for _, w := range c.Walls {
+		if w.Contains(p) {
+			return 0
+		}
+		for i := range w {
+			if t, ok := rayIntersection(p, dir, w[i], w[(i+1)%len(w)]); ok && t < d {
+				d = t
+			}
+		}
+	}
+	return d
+}
+
+// InWall returns true if the point is inside a wall.
+func (c *Course) InWall(x, y float64) bool {
+	for _, w := range c.Walls {
+		if w.Contains(Point{x, y}) {
+			return true
+		}
+	}
+	return false
+}
+
+// InBasket returns true if the point is in the zone of the candy basket.
+func (c *Course) InBasket(x, y float64) bool {
+	return len(c.Basket) > 0 && c.Basket.Contains(Point{x, y})
+}
+
+// OnBoard returns true if the point is on the board.
+func (c *Course) OnBoard(x, y float64) bool {
+	return x >= 0 && y >= 0 && x <= c.Width && y <= c.Height
+}
+
+// Contains returns true if the point is inside the polygon.
+func (poly Polygon) Contains(p Point) bool {
+	in := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a[1] > p[1]) != (b[1] > p[1]) &&
+			p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			in = !in
+		}
+	}
+	return in
+}
+
+// segmentDistance returns the distance from p to the segment [a, b].
+func segmentDistance(p, a, b Point) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / l
+		t = math.Max(0, math.Min(1, t))
+	}
+	return math.Hypot(p[0]-a[0]-t*dx, p[1]-a[1]-t*dy)
+}
+
+// rayIntersection returns the distance from p, along the unit vector dir, to
+// the segment [a, b].
+func rayIntersection(p, dir, a, b Point) (float64, bool) {
+	ex, ey := b[0]-a[0], b[1]-a[1]
+	den := dir[0]*ey - dir[1]*ex
+	if den == 0 {
+		return 0, false
+	}
+	qx, qy := a[0]-p[0], a[1]-p[1]
+	t := (qx*ey - qy*ex) / den
+	u := (qx*dir[1] - qy*dir[0]) / den
+	if t < 0 || u < 0 || u > 1 {
+		return 0, false
+	}
+	return t, true
+}
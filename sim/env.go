@@ -0,0 +1,39 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"math"
+)
+
+// Environment is what the sensors of the robot see.
+type Environment interface {
+	// IsBlack returns true if the floor is black at the given point.
+	IsBlack(x, y float64) bool
+	// Distance returns the distance from the given point to the nearest wall
+	// in the direction theta, or +Inf if there is no wall.
+	Distance(x, y, theta float64) float64
+}
+
+// Empty is an infinite white floor without any wall.
+type Empty struct{}
+
+func (Empty) IsBlack(x, y float64) bool {
+	return false
+}
+
+func (Empty) Distance(x, y, theta float64) float64 {
+	return math.Inf(1)
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"github.com/BlueMasters/thymio-captain/program"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Estimate is the expected duration of a program (seconds). Steps waiting for
+// a sensor (wall, black or white floor) have no estimate: their duration is
+// nil and the program is not Bounded.
+type Estimate struct {
+	Steps    []*float64 `json:"steps"`
+	Duration float64    `json:"duration"` // sum of the known durations
+	Bounded  bool       `json:"bounded"`
+}
+
+// ticks returns the duration of the ticks of the control loop needed for a
+// step of the given duration (see timeTicks).
+func ticks(seconds float64) float64 {
+	return millis(float64(timeTicks(seconds)) * Tick.Seconds())
+}
+
+func millis(seconds float64) float64 {
+	return math.Floor(seconds*1000+0.5) / 1000
+}
+
+// StepDuration returns the expected duration of a step, and false if the step
+// waits for a sensor. FollowLine is estimated with the robot always centered on
+// the line, so it may take longer.
+func StepDuration(c Calibration, s program.Step) (float64, bool) {
+	switch s.Action {
+	case "MoveForward", "MoveBackward", "FollowLine":
+		cm, err := centimeters(s.Param)
+		if err != nil {
+			return 0, false
+		}
+		return ticks(float64(cm) * c.CmTime), true
+	case "Turn":
+		angle, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(s.Param, "Left"), "Right"))
+		if err != nil {
+			return 0, false
+		}
+		return ticks(float64(angle) * c.AngleTime), true
+	}
+	return 0, true
+}
+
+// EstimateDuration returns the expected duration of a program executed by a
+// robot with the given calibration.
+func EstimateDuration(c Calibration, p program.Program) Estimate {
+	e := Estimate{Steps: make([]*float64, len(p)), Bounded: true}
+	for i, s := range p {
+		d, ok := StepDuration(c, s)
+		if !ok {
+			e.Bounded = false
+			continue
+		}
+		e.Steps[i] = &d
+		e.Duration = millis(e.Duration + d)
+	}
+	return e
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"github.com/BlueMasters/thymio-captain/program"
+	"testing"
+)
+
+// The estimates must give the duration of the simulations of the timed steps.
+func TestEstimateMatchesSimulate(t *testing.T) {
+	steps := []program.Step{
+		{Action: "MoveForward", Param: "10cm"},
+		{Action: "MoveForward", Param: "20cm"},
+		{Action: "MoveForward", Param: "50cm"},
+		{Action: "MoveBackward", Param: "10cm"},
+		{Action: "Turn", Param: "Left90"},
+		{Action: "Turn", Param: "Right45"},
+		{Action: "SetTopColor", Param: "red"},
+	}
+	for _, c := range []Calibration{DefaultCalibration, {CmTime: 0.13, AngleTime: 0.017, Wall: 3000, Floor: 500}} {
+		var all program.Program
+		for _, s := range steps {
+			p := program.Program{s}
+			all = append(all, s)
+			want := Simulate(nil, c, p).Duration
+			if got := EstimateDuration(c, p).Duration; got != millis(want) {
+				t.Errorf("%+v %v %v: estimate %v, simulation %v", c, s.Action, s.Param, got, want)
+			}
+		}
+		want := Simulate(nil, c, all).Duration
+		if got := EstimateDuration(c, all).Duration; got != millis(want) {
+			t.Errorf("%+v program: estimate %v, simulation %v", c, got, want)
+		}
+	}
+}
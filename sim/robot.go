@@ -0,0 +1,160 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sim simulates a Thymio robot running the Thymio Captain firmware.
+// The robot is a differential drive moving on a 2D plane, with two ground
+// sensors and proximity sensors in the front and in the back. The programs are
+// executed in virtual time, with the same control loop as the firmware.
+package sim
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Tick is the period of the control loop of the firmware.
+	Tick = 100 * time.Millisecond
+
+	// motorSpeed is the speed used by the firmware for the motors.
+	motorSpeed = 300
+
+	// Geometry of the Thymio (cm, from the center of the wheel axis).
+	groundAhead = 6.0
+	groundSide  = 1.0
+	proxFront   = 6.0
+	proxBack    = 3.0
+	proxSide    = 3.0
+	proxRange   = 10.0
+	proxMax     = 4500.0
+	groundLimit = 500
+)
+
+// Pose is the position (cm) and the heading (radians, counterclockwise from
+// the x axis) of the robot.
+type Pose struct {
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	Theta float64 `json:"theta"`
+}
+
+// Calibration holds the constants measured by the calibration of the robot.
+// The JSON names are the ones of the "/state" method of the firmware.
+type Calibration struct {
+	CmTime    float64 `json:"TIME_CM_CONV"`    // seconds per cm
+	AngleTime float64 `json:"TIME_ANGLE_CONV"` // seconds per degree
+	Wall      float64 `json:"WALL_VALUE"`      // front proximity threshold
+	Floor     float64 `json:"FLOOR_VALUE"`     // ground threshold (black below)
+}
+
+// DefaultCalibration is the calibration of an uncalibrated firmware.
+var DefaultCalibration = Calibration{
+	CmTime:    0.2,
+	AngleTime: 0.025,
+	Wall:      3000,
+	Floor:     groundLimit,
+}
+
+// Robot is a simulated Thymio.
+type Robot struct {
+	Pose        Pose          `json:"pose"`
+	Left        float64       `json:"left"`
+	Right       float64       `json:"right"`
+	TopColor    string        `json:"topColor"`
+	BottomColor string        `json:"bottomColor"`
+	Time        time.Duration `json:"-"`
+	Calibration Calibration   `json:"calibration"`
+	Env         Environment   `json:"-"`
+}
+
+// NewRobot returns a robot at the given pose in env.
+func NewRobot(env Environment, pose Pose) *Robot {
+	return &Robot{
+		Pose:        pose,
+		TopColor:    "off",
+		BottomColor: "off",
+		Calibration: DefaultCalibration,
+		Env:         env,
+	}
+}
+
+// SetMotors sets the speed of the motors, as the firmware does.
+func (r *Robot) SetMotors(left, right float64) {
+	r.Left = left
+	r.Right = right
+}
+
+// Move integrates the motion of the robot during dt. A motor speed of 300
+// moves the robot by 1/CmTime cm per second and opposite speeds of 300 turn it
+// by 1/AngleTime degrees per second.
+func (r *Robot) Move(dt time.Duration) {
+	s := dt.Seconds()
+	v := (r.Left + r.Right) / 2 / motorSpeed / r.Calibration.CmTime
+	w := (r.Right - r.Left) / 2 / motorSpeed / r.Calibration.AngleTime * math.Pi / 180
+	theta := r.Pose.Theta + w*s/2
+	r.Pose.X += v * s * math.Cos(theta)
+	r.Pose.Y += v * s * math.Sin(theta)
+	r.Pose.Theta = math.Remainder(r.Pose.Theta+w*s, 2*math.Pi)
+	r.Time += dt
+}
+
+// point returns the position of a point given relative to the robot.
+func (r *Robot) point(ahead, left float64) (x, y float64) {
+	c, s := math.Cos(r.Pose.Theta), math.Sin(r.Pose.Theta)
+	return r.Pose.X + ahead*c - left*s, r.Pose.Y + ahead*s + left*c
+}
+
+// ground returns the value of a ground sensor: low on a black floor, high on a
+// white floor.
+func (r *Robot) ground(left float64) int {
+	x, y := r.point(groundAhead, left)
+	if r.Env.IsBlack(x, y) {
+		return 100
+	}
+	return 900
+}
+
+// floor returns the threshold of the ground sensors. Firmwares without a
+// FLOOR_VALUE use the default.
+func (r *Robot) floor() int {
+	if r.Calibration.Floor <= 0 {
+		return groundLimit
+	}
+	return int(r.Calibration.Floor)
+}
+
+// Ground returns the values of the left and right ground sensors.
+func (r *Robot) Ground() [2]int {
+	return [2]int{r.ground(groundSide), r.ground(-groundSide)}
+}
+
+// prox returns the value of a proximity sensor looking in the given direction.
+func (r *Robot) prox(ahead, left, direction float64) float64 {
+	x, y := r.point(ahead, left)
+	d := r.Env.Distance(x, y, r.Pose.Theta+direction)
+	if d >= proxRange {
+		return 0
+	}
+	return proxMax * (1 - d/proxRange)
+}
+
+// ProxFront returns the value of the center front proximity sensor.
+func (r *Robot) ProxFront() float64 {
+	return r.prox(proxFront, 0, 0)
+}
+
+// ProxBack returns the values of the two back proximity sensors.
+func (r *Robot) ProxBack() [2]float64 {
+	return [2]float64{r.prox(-proxBack, proxSide, math.Pi), r.prox(-proxBack, -proxSide, math.Pi)}
+}
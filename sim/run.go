@@ -0,0 +1,343 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"github.com/BlueMasters/thymio-captain/program"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons for the end of a step.
+const (
+	ReasonDone       = "done"       // distance, angle or color reached
+	ReasonWall       = "wall"       // a wall was detected
+	ReasonBlackFloor = "blackFloor" // the floor became black
+	ReasonWhiteFloor = "whiteFloor" // the floor became white
+	ReasonStopped    = "stopped"    // the run was stopped
+	ReasonTimeout    = "timeout"    // the sensor never triggered
+	ReasonError      = "error"      // the step is not understood by the firmware
+	ReasonCrash      = "crash"      // the robot hit a wall (simulation only)
+	ReasonOffBoard   = "offBoard"   // the robot left the board (simulation only)
+)
+
+// Outcomes of a run.
+const (
+	Running  = "running"
+	Finished = "finished"
+	Stopped  = "stopped"
+	TimedOut = "timeout"
+	Failed   = "error"
+	Crashed  = "crash"
+	OffBoard = "offBoard"
+)
+
+// DefaultStepTimeout bounds the duration of a step. The firmware has no such
+// limit: a robot waiting for a wall that never comes just keeps moving.
+const DefaultStepTimeout = 60 * time.Second
+
+// StepResult describes the execution of a step. The times are in seconds from
+// the start of the run.
+type StepResult struct {
+	Index  int     `json:"index"`
+	Action string  `json:"action"`
+	Param  string  `json:"param"`
+	Start  float64 `json:"start"`
+	End    float64 `json:"end"`
+	Reason string  `json:"reason"`
+}
+
+// Run is the execution of a program by a robot. It follows the control loop of
+// the firmware (progRunner in thymio/flask_dev/server.py).
+type Run struct {
+	Robot       *Robot
+	Program     program.Program
+	Step        int          // index of the current step
+	Steps       []StepResult // steps already executed
+	Outcome     string
+	StepTimeout time.Duration
+
+	askStop bool
+	ctrl    controller
+	begin   time.Duration
+	start   time.Duration
+}
+
+// controller is called at every tick of a step. It may change the motors and
+// returns true (with a reason) when the step is over.
+type controller func() (done bool, reason string)
+
+// NewRun prepares the execution of p by robot.
+func NewRun(robot *Robot, p program.Program) *Run {
+	return &Run{
+		Robot:       robot,
+		Program:     p,
+		Steps:       make([]StepResult, 0, len(p)),
+		Outcome:     Running,
+		StepTimeout: DefaultStepTimeout,
+		begin:       robot.Time,
+	}
+}
+
+// Stop asks the run to stop at the next tick.
+func (x *Run) Stop() {
+	x.askStop = true
+}
+
+// Elapsed returns the time since the start of the run.
+func (x *Run) Elapsed() time.Duration {
+	return x.Robot.Time - x.begin
+}
+
+// Tick advances the run by one tick. Steps that do not take time (colors) are
+// executed without moving the robot. Tick returns false when the run is over.
+func (x *Run) Tick() bool {
+	for x.Outcome == Running {
+		if x.askStop {
+			if x.ctrl != nil {
+				x.endStep(ReasonStopped)
+			}
+			x.finish(Stopped)
+			return false
+		}
+		if x.ctrl == nil {
+			if x.Step >= len(x.Program) {
+				x.finish(Finished)
+				return false
+			}
+			x.start = x.Robot.Time
+			x.ctrl = x.controller(x.Program[x.Step])
+		}
+		if done, reason := x.ctrl(); done {
+			x.endStep(reason)
+			if reason == ReasonError {
+				x.finish(Failed)
+				return false
+			}
+			continue
+		}
+		if x.Robot.Time-x.start >= x.StepTimeout {
+			x.endStep(ReasonTimeout)
+			x.finish(TimedOut)
+			return false
+		}
+		x.Robot.Move(Tick)
+		return true
+	}
+	return false
+}
+
+// Abort ends the current step with reason and the run with outcome.
+func (x *Run) Abort(reason, outcome string) {
+	if x.Outcome != Running {
+		return
+	}
+	if x.ctrl != nil {
+		x.endStep(reason)
+	}
+	x.finish(outcome)
+}
+
+// Finish executes the run until its end.
+func (x *Run) Finish() {
+	for x.Tick() {
+	}
+}
+
+func (x *Run) endStep(reason string) {
+	s := x.Program[x.Step]
+	x.Steps = append(x.Steps, StepResult{
+		Index:  x.Step,
+		Action: s.Action,
+		Param:  s.Param,
+		Start:  (x.start - x.begin).Seconds(),
+		End:    x.Elapsed().Seconds(),
+		Reason: reason,
+	})
+	x.Step++
+	x.ctrl = nil
+}
+
+// finish stops the motors and switches the LEDs off, as the firmware does at
+// the end of a program.
+func (x *Run) finish(outcome string) {
+	x.Robot.SetMotors(0, 0)
+	x.Robot.TopColor = "off"
+	x.Robot.BottomColor = "off"
+	x.Outcome = outcome
+}
+
+func failed() (bool, string) {
+	return true, ReasonError
+}
+
+// controller returns the controller of a step.
+func (x *Run) controller(s program.Step) controller {
+	r := x.Robot
+	switch s.Action {
+	case "MoveForward":
+		r.SetMotors(motorSpeed, motorSpeed)
+		switch s.Param {
+		case "UntilWall":
+			return x.until(func() bool { return r.ProxFront() >= r.Calibration.Wall }, ReasonWall)
+		case "UntilBlackFloor":
+			return x.untilBlackFloor()
+		case "UntilWhiteFloor":
+			return x.untilWhiteFloor()
+		case "10cm", "20cm", "50cm":
+			return x.untilCm(s.Param)
+		}
+	case "MoveBackward":
+		r.SetMotors(-motorSpeed, -motorSpeed)
+		switch s.Param {
+		case "UntilWall":
+			return x.until(func() bool {
+				p := r.ProxBack()
+				return p[0] >= 1000 || p[1] >= 1000
+			}, ReasonWall)
+		case "UntilBlackFloor":
+			return x.untilBlackFloor()
+		case "UntilWhiteFloor":
+			return x.untilWhiteFloor()
+		default:
+			return x.untilCm(s.Param)
+		}
+	case "Turn":
+		var angle int
+		var err error
+		if strings.HasPrefix(s.Param, "Right") {
+			angle, err = strconv.Atoi(s.Param[5:])
+			r.SetMotors(motorSpeed, -motorSpeed)
+		} else if strings.HasPrefix(s.Param, "Left") {
+			angle, err = strconv.Atoi(s.Param[4:])
+			r.SetMotors(-motorSpeed, motorSpeed)
+		} else {
+			break
+		}
+		if err != nil {
+			break
+		}
+		return x.untilTime(float64(angle) * r.Calibration.AngleTime)
+	case "FollowLine":
+		if s.Param == "UntilWall" {
+			return x.followLine(func(float64) bool { return r.ProxFront() >= r.Calibration.Wall }, ReasonWall)
+		}
+		cm, err := centimeters(s.Param)
+		if err != nil {
+			break
+		}
+		target := float64(cm) * r.Calibration.CmTime
+		return x.followLine(func(t float64) bool { return t >= target }, ReasonDone)
+	case "SetTopColor":
+		r.TopColor = s.Param
+		return func() (bool, string) { return true, ReasonDone }
+	case "SetBottomColor":
+		r.BottomColor = s.Param
+		return func() (bool, string) { return true, ReasonDone }
+	}
+	return failed
+}
+
+// centimeters parses a distance parameter such as "20cm".
+func centimeters(param string) (int, error) {
+	return strconv.Atoi(strings.TrimSuffix(param, "cm"))
+}
+
+func (x *Run) until(cond func() bool, reason string) controller {
+	return func() (bool, string) {
+		return cond(), reason
+	}
+}
+
+func (x *Run) untilBlackFloor() controller {
+	r := x.Robot
+	return x.until(func() bool {
+		g, limit := r.Ground(), r.floor()
+		return g[0] <= limit || g[1] <= limit
+	}, ReasonBlackFloor)
+}
+
+func (x *Run) untilWhiteFloor() controller {
+	r := x.Robot
+	return x.until(func() bool {
+		g, limit := r.Ground(), r.floor()
+		return g[0] >= limit || g[1] >= limit
+	}, ReasonWhiteFloor)
+}
+
+func (x *Run) untilCm(param string) controller {
+	cm, err := centimeters(param)
+	if err != nil {
+		return failed
+	}
+	return x.untilTime(float64(cm) * x.Robot.Calibration.CmTime)
+}
+
+// untilTime waits for target seconds, counting the ticks like the firmware.
+func (x *Run) untilTime(target float64) controller {
+	n := timeTicks(target)
+	return func() (bool, string) {
+		if n > 0 {
+			n--
+			return false, ""
+		}
+		return true, ReasonDone
+	}
+}
+
+// timeTicks returns the number of ticks of a step of target seconds: the
+// firmware adds the period of a tick to its counter until it reaches the
+// target.
+func timeTicks(target float64) int {
+	n := 0
+	for t := 0.0; t < target; t += Tick.Seconds() {
+		n++
+	}
+	return n
+}
+
+// followLine follows the border of a black line. The time only counts while
+// the robot is on the line, as in the firmware.
+func (x *Run) followLine(stop func(t float64) bool, reason string) controller {
+	r := x.Robot
+	t := 0.0
+	left := true
+	return func() (bool, string) {
+		if stop(t) {
+			r.SetMotors(0, 0)
+			return true, reason
+		}
+		g, limit := r.Ground(), r.floor()
+		switch {
+		case g[0] < limit && g[1] < limit:
+			r.SetMotors(motorSpeed, motorSpeed)
+			t += 0.1
+		case g[0] < limit && g[1] > limit:
+			r.SetMotors(50, motorSpeed)
+			left = true
+			t += 0.06
+		case g[0] > limit && g[1] < limit:
+			r.SetMotors(motorSpeed, 50)
+			left = false
+			t += 0.06
+		case left:
+			r.SetMotors(-200, 200)
+		default:
+			r.SetMotors(200, -200)
+		}
+		return false, ""
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"github.com/BlueMasters/thymio-captain/program"
+)
+
+// trajectoryTicks is the number of ticks between two points of the trajectory.
+const trajectoryTicks = 5
+
+// Simulation is the predicted outcome of a program.
+type Simulation struct {
+	Outcome    string       `json:"outcome"`
+	Duration   float64      `json:"duration"` // seconds
+	Trajectory []Pose       `json:"trajectory"`
+	End        Pose         `json:"end"`
+	Basket     bool         `json:"basket"` // the basket zone was reached
+	Steps      []StepResult `json:"steps"`
+	FailedStep *StepResult  `json:"failedStep,omitempty"`
+}
+
+// Simulate executes p from the start of the course, as fast as possible, and
+// reports what happened. The run stops when the robot hits a wall or leaves the
+// board. Without a course, the robot starts at the origin of an empty floor.
+func Simulate(course *Course, calibration Calibration, p program.Program) *Simulation {
+	var robot *Robot
+	if course != nil {
+		robot = NewRobot(course, course.Start)
+	} else {
+		robot = NewRobot(Empty{}, Pose{})
+	}
+	robot.Calibration = calibration
+
+	res := &Simulation{Trajectory: []Pose{robot.Pose}}
+	run := NewRun(robot, p)
+	for ticks := 1; run.Tick(); ticks++ {
+		if course != nil {
+			if course.InBasket(robot.Pose.X, robot.Pose.Y) {
+				res.Basket = true
+			}
+			CheckCourse(course, run)
+		}
+		if ticks%trajectoryTicks == 0 {
+			res.Trajectory = append(res.Trajectory, robot.Pose)
+		}
+	}
+	if last := res.Trajectory[len(res.Trajectory)-1]; last != robot.Pose {
+		res.Trajectory = append(res.Trajectory, robot.Pose)
+	}
+
+	res.Outcome = run.Outcome
+	res.Duration = run.Elapsed().Seconds()
+	res.End = robot.Pose
+	res.Steps = run.Steps
+	for i, s := range run.Steps {
+		switch s.Reason {
+		case ReasonTimeout, ReasonError, ReasonCrash, ReasonOffBoard:
+			res.FailedStep = &run.Steps[i]
+		}
+	}
+	return res
+}
+
+// CheckCourse aborts the run when its robot hits a wall or leaves the board of
+// the course, and returns true if it did. Without a course, nothing is checked.
+func CheckCourse(course *Course, run *Run) bool {
+	if course == nil {
+		return false
+	}
+	if crashed(course, run.Robot) {
+		run.Abort(ReasonCrash, Crashed)
+		return true
+	}
+	if !course.OnBoard(run.Robot.Pose.X, run.Robot.Pose.Y) {
+		run.Abort(ReasonOffBoard, OffBoard)
+		return true
+	}
+	return false
+}
+
+// crashed returns true if the front or the back of the robot is in a wall.
+func crashed(course *Course, r *Robot) bool {
+	for _, ahead := range []float64{proxFront, 0, -proxBack} {
+		if course.InWall(r.point(ahead, 0)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,374 @@
+// Copyright 2016 Jacques Supcik <jacques.supcik@hefr.ch>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sim
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Colors used in the drawings of the boards (see board/portes-ouvertes-2016.svg).
+const (
+	blackColor = "#000000" // lines (stroke) and areas (fill)
+	wallColor  = "#fbaf5f" // walls (fill)
+	startColor = "#5f9efb" // start zone (fill)
+)
+
+// bezierSegments is the number of segments used to draw a Bézier curve.
+const bezierSegments = 8
+
+// svgNode is a generic SVG element.
+type svgNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Nodes   []svgNode  `xml:",any"`
+}
+
+func (n *svgNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *svgNode) float(name string) float64 {
+	f, _ := strconv.ParseFloat(n.attr(name), 64)
+	return f
+}
+
+// style returns a property of the element, from the style attribute or from
+// the presentation attribute.
+func (n *svgNode) style(name string) string {
+	for _, s := range strings.Split(n.attr("style"), ";") {
+		kv := strings.SplitN(s, ":", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == name {
+			return strings.ToLower(strings.TrimSpace(kv[1]))
+		}
+	}
+	return strings.ToLower(n.attr(name))
+}
+
+// matrix is an affine transformation [a c e; b d f].
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+func (m matrix) mul(o matrix) matrix {
+	return matrix{
+		m[0]*o[0] + m[2]*o[1],
+		m[1]*o[0] + m[3]*o[1],
+		m[0]*o[2] + m[2]*o[3],
+		m[1]*o[2] + m[3]*o[3],
+		m[0]*o[4] + m[2]*o[5] + m[4],
+		m[1]*o[4] + m[3]*o[5] + m[5],
+	}
+}
+
+func (m matrix) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// scale returns the scaling factor of the transformation (for the widths).
+func (m matrix) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+var (
+	transformRe = regexp.MustCompile(`(\w+)\s*\(([^)]*)\)`)
+	numberRe    = regexp.MustCompile(`[-+]?(?:[0-9]*\.[0-9]+|[0-9]+\.?)(?:[eE][-+]?[0-9]+)?`)
+	pathRe      = regexp.MustCompile(`[MmLlHhVvCcZz]|[-+]?(?:[0-9]*\.[0-9]+|[0-9]+\.?)(?:[eE][-+]?[0-9]+)?`)
+)
+
+func numbers(s string) []float64 {
+	var res []float64
+	for _, t := range numberRe.FindAllString(s, -1) {
+		f, _ := strconv.ParseFloat(t, 64)
+		res = append(res, f)
+	}
+	return res
+}
+
+// parseTransform parses the transform attribute of an element.
+func parseTransform(s string) (matrix, error) {
+	m := identity
+	for _, t := range transformRe.FindAllStringSubmatch(s, -1) {
+		v := numbers(t[2])
+		var o matrix
+		switch {
+		case t[1] == "matrix" && len(v) == 6:
+			copy(o[:], v)
+		case t[1] == "translate" && len(v) == 1:
+			o = matrix{1, 0, 0, 1, v[0], 0}
+		case t[1] == "translate" && len(v) == 2:
+			o = matrix{1, 0, 0, 1, v[0], v[1]}
+		case t[1] == "scale" && len(v) == 1:
+			o = matrix{v[0], 0, 0, v[0], 0, 0}
+		case t[1] == "scale" && len(v) == 2:
+			o = matrix{v[0], 0, 0, v[1], 0, 0}
+		case t[1] == "rotate" && len(v) == 1:
+			a := v[0] * math.Pi / 180
+			o = matrix{math.Cos(a), math.Sin(a), -math.Sin(a), math.Cos(a), 0, 0}
+		default:
+			return m, fmt.Errorf("Unsupported transform: %v", t[0])
+		}
+		m = m.mul(o)
+	}
+	return m, nil
+}
+
+// parsePath returns the subpaths of a path, with a flag telling if the subpath
+// is closed.
+func parsePath(d string) (paths [][]Point, closed []bool, err error) {
+	tokens := pathRe.FindAllString(d, -1)
+	var cur []Point
+	var x, y, x0, y0 float64
+	var cmd string
+	end := func(c bool) {
+		if len(cur) > 1 {
+			paths = append(paths, cur)
+			closed = append(closed, c)
+		}
+		cur = nil
+	}
+	for i := 0; i < len(tokens); {
+		if strings.ContainsAny(tokens[i], "MmLlHhVvCcZz") {
+			cmd = tokens[i]
+			i++
+		}
+		args := func(n int) ([]float64, bool) {
+			if i+n > len(tokens) {
+				return nil, false
+			}
+			v := make([]float64, n)
+			for k := 0; k < n; k++ {
+				f, err := strconv.ParseFloat(tokens[i+k], 64)
+				if err != nil {
+					return nil, false
+				}
+				v[k] = f
+			}
+			i += n
+			return v, true
+		}
+		rel := strings.ToLower(cmd) == cmd
+		dx, dy := 0.0, 0.0
+		if rel {
+			dx, dy = x, y
+		}
+		switch strings.ToLower(cmd) {
+		case "m":
+			v, ok := args(2)
+			if !ok {
+				return nil, nil, fmt.Errorf("Invalid path: %v", d)
+			}
+			end(false)
+			x, y = v[0]+dx, v[1]+dy
+			x0, y0 = x, y
+			cur = []Point{{x, y}}
+			// the next pairs are implicit line-to
+			if rel {
+				cmd = "l"
+			} else {
+				cmd = "L"
+			}
+		case "l":
+			v, ok := args(2)
+			if !ok {
+				return nil, nil, fmt.Errorf("Invalid path: %v", d)
+			}
+			x, y = v[0]+dx, v[1]+dy
+			cur = append(cur, Point{x, y})
+		case "h":
+			v, ok := args(1)
+			if !ok {
+				return nil, nil, fmt.Errorf("Invalid path: %v", d)
+			}
+			x = v[0] + dx
+			cur = append(cur, Point{x, y})
+		case "v":
+			v, ok := args(1)
+			if !ok {
+				return nil, nil, fmt.Errorf("Invalid path: %v", d)
+			}
+			y = v[0] + dy
+			cur = append(cur, Point{x, y})
+		case "c":
+			v, ok := args(6)
+			if !ok {
+				return nil, nil, fmt.Errorf("Invalid path: %v", d)
+			}
+			p0 := Point{x, y}
+			p1 := Point{v[0] + dx, v[1] + dy}
+			p2 := Point{v[2] + dx, v[3] + dy}
+			p3 := Point{v[4] + dx, v[5] + dy}
+			for k := 1; k <= bezierSegments; k++ {
+				t := float64(k) / bezierSegments
+				a, b, c, e := (1-t)*(1-t)*(1-t), 3*(1-t)*(1-t)*t, 3*(1-t)*t*t, t*t*t
+				cur = append(cur, Point{
+					a*p0[0] + b*p1[0] + c*p2[0] + e*p3[0],
+					a*p0[1] + b*p1[1] + c*p2[1] + e*p3[1],
+				})
+			}
+			x, y = p3[0], p3[1]
+		case "z":
+			x, y = x0, y0
+			end(true)
+			if i < len(tokens) && !strings.ContainsAny(tokens[i], "MmLlHhVvCcZz") {
+				return nil, nil, fmt.Errorf("Invalid path: %v", d)
+			}
+		default:
+			return nil, nil, fmt.Errorf("Unsupported path command %q in %v", cmd, d)
+		}
+	}
+	end(false)
+	return
+}
+
+// svgLoader converts the shapes of the drawing into the elements of a course.
+type svgLoader struct {
+	course *Course
+	scale  float64 // user units per cm
+	minX   float64
+	minY   float64
+}
+
+// toCourse converts a point of the drawing into a point of the course.
+func (l *svgLoader) toCourse(m matrix, x, y float64) Point {
+	x, y = m.apply(x, y)
+	return Point{
+		round((x - l.minX) / l.scale),
+		round(l.course.Height - (y-l.minY)/l.scale),
+	}
+}
+
+func round(f float64) float64 {
+	return math.Floor(f*100+0.5) / 100
+}
+
+func (l *svgLoader) walk(n *svgNode, parent matrix) error {
+	t, err := parseTransform(n.attr("transform"))
+	if err != nil {
+		return err
+	}
+	m := parent.mul(t)
+
+	var shapes [][]Point
+	var closed []bool
+	switch n.XMLName.Local {
+	case "defs", "clipPath", "metadata", "namedview":
+		return nil
+	case "g", "svg":
+		for i := range n.Nodes {
+			if err := l.walk(&n.Nodes[i], m); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "rect":
+		x, y, w, h := n.float("x"), n.float("y"), n.float("width"), n.float("height")
+		shapes = [][]Point{{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}}}
+		closed = []bool{true}
+	case "path":
+		shapes, closed, err = parsePath(n.attr("d"))
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	id := strings.ToLower(n.attr("id") + " " + n.attr("label"))
+	fill, stroke := n.style("fill"), n.style("stroke")
+	for i, s := range shapes {
+		pts := make([]Point, len(s))
+		for k, p := range s {
+			pts[k] = l.toCourse(m, p[0], p[1])
+		}
+		switch {
+		case strings.Contains(id, "basket"):
+			l.course.Basket = Polygon(pts)
+		case fill == wallColor:
+			l.course.Walls = append(l.course.Walls, Polygon(pts))
+		case fill == startColor:
+			var cx, cy float64
+			for _, p := range pts {
+				cx, cy = cx+p[0], cy+p[1]
+			}
+			l.course.Start = Pose{X: round(cx / float64(len(pts))), Y: round(cy / float64(len(pts))), Theta: math.Pi / 2}
+		case fill == blackColor && closed[i]:
+			l.course.Areas = append(l.course.Areas, Polygon(pts))
+		case stroke == blackColor:
+			w, _ := strconv.ParseFloat(strings.TrimSuffix(n.style("stroke-width"), "px"), 64)
+			l.course.Lines = append(l.course.Lines, Line{Points: pts, Width: round(w * m.scale() / l.scale)})
+		}
+	}
+	return nil
+}
+
+// length converts a length of the root element ("77cm", "770mm") into cm.
+func length(s string) (float64, error) {
+	for unit, factor := range map[string]float64{"cm": 1, "mm": 0.1} {
+		if strings.HasSuffix(s, unit) {
+			f, err := strconv.ParseFloat(strings.TrimSuffix(s, unit), 64)
+			return f * factor, err
+		}
+	}
+	return 0, fmt.Errorf("The size of the board must be given in cm or mm: %v", s)
+}
+
+// LoadSVG reads a course from a drawing of the board. The size of the drawing
+// must be given in cm or mm. The elements are recognized by their color:
+// black strokes are lines and black closed shapes are areas, shapes filled
+// with #fbaf5f are walls and the center of the shape filled with #5f9efb is
+// the start position (facing the top of the board). A shape with "basket" in
+// its id or label is the zone of the candy basket.
+func LoadSVG(fileName string) (*Course, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var root svgNode
+	err = xml.NewDecoder(f).Decode(&root)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SVG %v: %v", fileName, err)
+	}
+
+	c := &Course{Name: strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))}
+	c.Width, err = length(root.attr("width"))
+	if err != nil {
+		return nil, err
+	}
+	c.Height, err = length(root.attr("height"))
+	if err != nil {
+		return nil, err
+	}
+	l := &svgLoader{course: c, scale: 1}
+	if vb := numbers(root.attr("viewBox")); len(vb) == 4 {
+		l.minX, l.minY = vb[0], vb[1]
+		l.scale = vb[2] / c.Width
+	}
+	err = l.walk(&root, identity)
+	return c, err
+}
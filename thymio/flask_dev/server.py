@@ -13,9 +13,11 @@ api = Api(app)
 
 program = {}
 running = False;
+step = 0
 TIME_CM_CONV = 0.2
 TIME_ANGLE_CONV = 0.025
 WALL_VALUE = 3000
+FLOOR_VALUE = 500
 
 class progRunner(Thread):
     def __init__(self, prog):
@@ -42,7 +44,9 @@ class progRunner(Thread):
         self.thymio = ThymioController()
 
     def run(self):
-        for instr in self.prog:
+        global step
+        for i, instr in enumerate(self.prog):
+            step = i
             action = instr["Action"]
             param = instr["Param"]
             self.options[action](param)
@@ -126,12 +130,12 @@ class progRunner(Thread):
         return
 
     def until_black_floor(self):
-        while self.thymio.get_prox_v()[0] > 500 and self.thymio.get_prox_v()[1] > 500 and self.askStop is False:
+        while self.thymio.get_prox_v()[0] > FLOOR_VALUE and self.thymio.get_prox_v()[1] > FLOOR_VALUE and self.askStop is False:
             sleep(0.1)
         return
 
     def until_white_floor(self):
-        while self.thymio.get_prox_v()[0] < 500 and self.thymio.get_prox_v()[1] < 500 and self.askStop is False:
+        while self.thymio.get_prox_v()[0] < FLOOR_VALUE and self.thymio.get_prox_v()[1] < FLOOR_VALUE and self.askStop is False:
             sleep(0.1)
         return
 
@@ -147,12 +151,12 @@ class progRunner(Thread):
         left = True
         while self.thymio.get_prox_h()[2] < WALL_VALUE and self.askStop is False:
             ground = self.thymio.get_prox_v()
-            if ground[0]<500 and ground[1]<500:
+            if ground[0]<FLOOR_VALUE and ground[1]<FLOOR_VALUE:
                 self.thymio.set_motors(300,300)
-            elif ground[0]<500 and ground[1]>500:
+            elif ground[0]<FLOOR_VALUE and ground[1]>FLOOR_VALUE:
                 self.thymio.set_motors(50,300)
                 left = True
-            elif ground[0]>500 and ground[1]<500:
+            elif ground[0]>FLOOR_VALUE and ground[1]<FLOOR_VALUE:
                 self.thymio.set_motors(300,50)
                 left = False
             else:
@@ -168,14 +172,14 @@ class progRunner(Thread):
         time = 0.0
         while self.askStop is False and time < target_time:
             ground = self.thymio.get_prox_v()
-            if ground[0]<500 and ground[1]<500:
+            if ground[0]<FLOOR_VALUE and ground[1]<FLOOR_VALUE:
                 self.thymio.set_motors(300,300)
                 time += 0.1
-            elif ground[0]<500 and ground[1]>500:
+            elif ground[0]<FLOOR_VALUE and ground[1]>FLOOR_VALUE:
                 self.thymio.set_motors(50,300)
                 left = True
                 time += 0.06
-            elif ground[0]>500 and ground[1]<500:
+            elif ground[0]>FLOOR_VALUE and ground[1]<FLOOR_VALUE:
                 self.thymio.set_motors(300,50)
                 left = False
                 time += 0.06
@@ -195,10 +199,10 @@ class calibLineRunner(Thread):
 
     def run(self):
         self.thymio.set_motors(300,300)
-        while self.thymio.get_prox_v()[0] < 500 and self.thymio.get_prox_v()[1] < 500:
+        while self.thymio.get_prox_v()[0] < FLOOR_VALUE and self.thymio.get_prox_v()[1] < FLOOR_VALUE:
             sleep(0.1)
         a = datetime.now()
-        while self.thymio.get_prox_v()[0] > 500 and self.thymio.get_prox_v()[1] > 500:
+        while self.thymio.get_prox_v()[0] > FLOOR_VALUE and self.thymio.get_prox_v()[1] > FLOOR_VALUE:
             sleep(0.1)
         b = datetime.now()
         self.thymio.set_motors(0,0)
@@ -218,10 +222,10 @@ class calibRotRunner(Thread):
 
     def run(self):
         self.thymio.set_motors(300,-300)
-        while self.thymio.get_prox_v()[0] < 500:
+        while self.thymio.get_prox_v()[0] < FLOOR_VALUE:
             sleep(0.1)
         a = datetime.now()
-        while self.thymio.get_prox_v()[0] > 500:
+        while self.thymio.get_prox_v()[0] > FLOOR_VALUE:
             sleep(0.1)
         b = datetime.now()
         self.thymio.set_motors(0,0)
@@ -240,7 +244,7 @@ class calibWallRunner(Thread):
 
     def run(self):
         self.thymio.set_motors(100, 100)
-        while self.thymio.get_prox_v()[0] < 500 and self.thymio.get_prox_v()[1] < 500:
+        while self.thymio.get_prox_v()[0] < FLOOR_VALUE and self.thymio.get_prox_v()[1] < FLOOR_VALUE:
             sleep(0.1)
         self.thymio.set_motors(0,0)
         global WALL_VALUE
@@ -288,7 +292,33 @@ class prog(Resource):
 class state(Resource):
     def get(self):
         global running
-        return {"running":running,"TIME_CM_CONV":TIME_CM_CONV,"TIME_ANGLE_CONV":TIME_ANGLE_CONV,"WALL_VALUE":WALL_VALUE},200
+        return {"running":running,"TIME_CM_CONV":TIME_CM_CONV,"TIME_ANGLE_CONV":TIME_ANGLE_CONV,"WALL_VALUE":WALL_VALUE,"FLOOR_VALUE":FLOOR_VALUE,"step":step},200
+
+class calibration(Resource):
+    def put(self):
+        global running
+        global TIME_CM_CONV, TIME_ANGLE_CONV, WALL_VALUE, FLOOR_VALUE
+        if running:
+            return {"result":"already running"},200
+        values = request.get_json(silent=True)
+        if not isinstance(values, dict):
+            return {"result":"invalid calibration"},400
+        try:
+            cm = float(values.get("TIME_CM_CONV", TIME_CM_CONV))
+            angle = float(values.get("TIME_ANGLE_CONV", TIME_ANGLE_CONV))
+            wall = float(values.get("WALL_VALUE", WALL_VALUE))
+            floor = float(values.get("FLOOR_VALUE", FLOOR_VALUE))
+        except (TypeError, ValueError):
+            return {"result":"invalid calibration"},400
+        if cm <= 0 or angle <= 0 or wall <= 0 or floor <= 0:
+            return {"result":"invalid calibration"},400
+        TIME_CM_CONV, TIME_ANGLE_CONV, WALL_VALUE, FLOOR_VALUE = cm, angle, wall, floor
+        d["cm"] = cm
+        d["angle"] = angle
+        d["wall"] = wall
+        d["floor"] = floor
+        d.sync()
+        return {"result":"ok"},200
 
 class ping(Resource):
     def get(self):
@@ -340,6 +370,7 @@ api.add_resource(state, '/api/v1/state')
 api.add_resource(calibLine, '/api/v1/calibline')
 api.add_resource(calibRot, '/api/v1/calibrot')
 api.add_resource(calibWall, '/api/v1/calibwall')
+api.add_resource(calibration, '/api/v1/calibration')
 
 d = shelve.open("calib.conf")
 if "cm" in d:
@@ -348,6 +379,8 @@ if "angle" in d:
     TIME_ANGLE_CONV = d["angle"]
 if "wall" in d:
     WALL_VALUE = d["wall"]
+if "floor" in d:
+    FLOOR_VALUE = d["floor"]
 
 if __name__ == '__main__':
     app.run(debug=True)